@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/jsimonetti/rtnetlink"
+	"golang.org/x/sys/unix"
+)
+
+// An address of the Wireguard interface to add or remove
+type addressUpdate struct {
+	Address netip.Addr
+	Remove  bool
+}
+
+func (au addressUpdate) String() string {
+	if au.Remove {
+		return "-" + au.Address.String()
+	}
+	return "+" + au.Address.String()
+}
+
+// Returns the host addresses currently configured on the interface.
+func interfaceAddresses(iface *net.Interface) (map[netip.Addr]bool, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[netip.Addr]bool)
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ones, bits := ipnet.Mask.Size(); ones != bits {
+			continue // only host addresses are managed
+		}
+		if ip, ok := netip.AddrFromSlice(ipnet.IP); ok {
+			current[ip.Unmap()] = true
+		}
+	}
+	return current, nil
+}
+
+// Determines the address changes needed to assign the concentrator side address of every node
+// to the Wireguard interface, see [ffbs.NodeInfo.ConcentratorAddresses].
+//
+// Only addresses which match the derived concentrator address of their surrounding node range are
+// removed, so other addresses of the interface stay untouched. The node ranges are derived with the range
+// lengths of the address plan.
+func calculateAddressUpdates(nodes map[string]*ffbs.NodeInfo, concentrator ffbs.ConcentratorInfo, plan ffbs.AddressAllocator) ([]addressUpdate, error) {
+	iface, err := net.InterfaceByName(WG_DEVICENAME)
+	if err != nil {
+		return nil, err
+	}
+	current, err := interfaceAddresses(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := make(map[netip.Addr]bool)
+	for _, node := range nodes {
+		addr4, addr6 := node.ConcentratorAddresses(concentrator)
+		for _, addr := range []netip.Addr{addr4, addr6} {
+			if addr.IsValid() {
+				desired[addr] = true
+			}
+		}
+	}
+
+	updates := make([]addressUpdate, 0)
+	for addr := range desired {
+		if !current[addr] {
+			updates = append(updates, addressUpdate{Address: addr})
+		}
+	}
+	for addr := range current {
+		if desired[addr] {
+			continue
+		}
+		rangeLength := plan.V6RangeLength
+		if addr.Is4() {
+			rangeLength = plan.V4RangeLength
+		}
+		nodeRange := netip.PrefixFrom(addr, rangeLength).Masked()
+		if derived, err := ffbs.ConcentratorAddress(nodeRange, concentrator.ID); err == nil && derived == addr {
+			updates = append(updates, addressUpdate{Address: addr, Remove: true})
+		}
+	}
+	return updates, nil
+}
+
+// Adds or removes the addresses of the Wireguard interface using rtnetlink.
+func applyAddressUpdates(updates []addressUpdate) error {
+	iface, err := net.InterfaceByName(WG_DEVICENAME)
+	if err != nil {
+		return err
+	}
+
+	conn, err := rtnetlink.Dial(nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, update := range updates {
+		family := uint8(unix.AF_INET6)
+		if update.Address.Is4() {
+			family = unix.AF_INET
+		}
+		msg := &rtnetlink.AddressMessage{
+			Family:       family,
+			PrefixLength: uint8(update.Address.BitLen()),
+			Index:        uint32(iface.Index),
+			Attributes: &rtnetlink.AddressAttributes{
+				Address: update.Address.AsSlice(),
+				Local:   update.Address.AsSlice(),
+			},
+		}
+
+		if update.Remove {
+			err = conn.Address.Delete(msg)
+		} else {
+			err = conn.Address.New(msg)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't apply address update %s: %w", update, err)
+		}
+	}
+	return nil
+}
@@ -1,13 +1,27 @@
 /*
 concentratorconfig configures the Wireguard interface based on the etcd KV configuration.
 It checks every minute for updates and applies these in Wireguard.
+Nodes blocked by the access control lists in etcd are removed from the Wireguard interface.
+The allowed IPs of every node are its ranges and its additional routed prefixes.
 If an error occurs, it will print it and won't update any node.
 
 Pass the simulate argument to only show the wireguard interface changes that would be applied.
 When it is started this way, it exits after printing the changes.
 
+Pass the -concentrator-id flag to additionally assign the concentrator side address of every node to the
+Wireguard interface. These are the same addresses the nodes receive from etcdconfigweb, either the static
+address of the concentrator registry or the address derived from the node range
+(see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.NodeInfo.ConcentratorAddresses]). Addresses of the
+interface are only removed if they are the derived concentrator address of a node range of the stored address plan
+(see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.EtcdHandler.GetAddressPlan]).
+
+The program exits if the etcd schema version is newer than the supported version
+(see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.EtcdHandler.CheckSchemaVersion]).
+
 The program expects a fixed Wireguard interface name (see [WG_DEVICENAME]) and
 an etcd configuration file at a fixed location (see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.CreateEtcdConnection]).
+Set the FFBS_NODE_STORE_DIR environment variable to use a directory of JSON files instead of etcd
+(see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.FileNodeStore]).
 */
 package main
 
@@ -15,10 +29,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"sort"
 	"time"
 
@@ -41,12 +56,28 @@ func sortIPNet(s []net.IPNet) {
 	})
 }
 
-func calculateWGPeerUpdates(etcd *ffbs.EtcdHandler, wg *wgctrl.Client) ([]wgtypes.PeerConfig, error) {
-	nodes, defNode, err := etcd.GetAllNodeInfo(context.Background())
+// Returns all nodes permitted by the access control lists and the default node.
+func getNodes(store ffbs.NodeStore) (map[string]*ffbs.NodeInfo, *ffbs.NodeInfo, error) {
+	nodes, defNode, err := store.GetAllNodeInfo(context.Background())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	// blocked nodes are handled like removed nodes
+	acl, err := store.GetACL(context.Background())
+	if err != nil {
+		return nil, nil, err
+	}
+	for pubkey := range nodes {
+		if acl.Check(pubkey) != nil {
+			delete(nodes, pubkey)
+		}
+	}
+	return nodes, defNode, nil
+}
+
+// Determines the peer changes of the Wireguard interface. The passed nodes map is modified.
+func calculateWGPeerUpdates(nodes map[string]*ffbs.NodeInfo, defNode *ffbs.NodeInfo, wg *wgctrl.Client) ([]wgtypes.PeerConfig, error) {
 	dev, err := wg.Device(WG_DEVICENAME)
 	if err != nil {
 		return nil, err
@@ -140,9 +171,13 @@ func calculateWGPeerUpdates(etcd *ffbs.EtcdHandler, wg *wgctrl.Client) ([]wgtype
 }
 
 func main() {
+	var concentratorID uint
+	flag.UintVar(&concentratorID, "concentrator-id", 0, "assign the concentrator side addresses of this concentrator id to the interface")
+	flag.Parse()
+
 	simulate := false
-	if len(os.Args) > 1 {
-		switch os.Args[1] {
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
 		case "simulate":
 			simulate = true
 		default:
@@ -150,9 +185,9 @@ func main() {
 		}
 	}
 
-	etcd, err := ffbs.CreateEtcdConnection()
+	store, err := ffbs.OpenNodeStore()
 	if err != nil {
-		log.Fatalln("Couldn't setup etcd connection:", err)
+		log.Fatalln("Couldn't open the node store:", err)
 	}
 
 	wg, err := wgctrl.New()
@@ -163,15 +198,69 @@ func main() {
 	for {
 		// misusing a loop to break at any moment and still run the sleep call
 		for {
-			updates, err := calculateWGPeerUpdates(etcd, wg)
+			// refuse to touch the interface if the etcd layout isn't understood anymore
+			if err := store.CheckSchemaVersion(context.Background()); err != nil && !errors.Is(err, ffbs.ErrUnsupportedByFileStore) {
+				var tooNew *ffbs.SchemaTooNewError
+				if errors.As(err, &tooNew) {
+					log.Fatalln("Couldn't use the node store:", err)
+				}
+				log.Println("Error trying to check the schema version:", err)
+				break
+			}
+
+			plan, err := store.GetAddressPlan(context.Background())
+			if err != nil {
+				log.Println("Error trying to get the address plan:", err)
+				break
+			}
+
+			nodes, defNode, err := getNodes(store)
+			if err != nil {
+				log.Println("Error trying to get the nodes:", err)
+				break
+			}
+
+			var addrUpdates []addressUpdate
+			if concentratorID > 0 {
+				concentrators, err := store.GetConcentrators(context.Background())
+				if err != nil {
+					log.Println("Error trying to get the concentrators:", err)
+					break
+				}
+				// unregistered concentrators only use the derived addresses
+				concentrator := ffbs.ConcentratorInfo{ID: uint32(concentratorID)}
+				for _, c := range concentrators {
+					if c.ID == concentrator.ID {
+						concentrator = c
+					}
+				}
+
+				addrUpdates, err = calculateAddressUpdates(nodes, concentrator, plan)
+				if err != nil {
+					log.Println("Error trying to determine the address updates:", err)
+					break
+				}
+			}
+
+			updates, err := calculateWGPeerUpdates(nodes, defNode, wg)
 			if err != nil {
 				log.Println("Error trying to determine the node updates:", err)
 				break
 			}
 			if simulate {
 				fmt.Printf("Peer updates: %v\n", updates)
+				fmt.Printf("Address updates: %v\n", addrUpdates)
 				return
 			}
+
+			if len(addrUpdates) > 0 {
+				if err := applyAddressUpdates(addrUpdates); err != nil {
+					log.Println("Error trying to apply the address updates:", err)
+					break
+				}
+				log.Println("Updated", len(addrUpdates), "addresses")
+			}
+
 			if len(updates) == 0 {
 				break
 			}
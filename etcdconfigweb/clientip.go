@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// The forwarding headers which may be used to determine the client address, see [clientAddr]
+var FORWARDED_HEADERS = []string{"Forwarded", "X-Forwarded-For", "X-Real-IP"}
+
+var ErrUnknownForwardedHeader = errors.New("Unknown forwarding header")
+
+// Returns the name of the forwarding header as written in [FORWARDED_HEADERS], the case is ignored.
+func parseForwardedHeader(name string) (string, error) {
+	for _, header := range FORWARDED_HEADERS {
+		if strings.EqualFold(name, header) {
+			return header, nil
+		}
+	}
+	return "", fmt.Errorf("%w '%s', expected one of %s", ErrUnknownForwardedHeader, name, strings.Join(FORWARDED_HEADERS, ", "))
+}
+
+// Returns the address of the client which sent the request.
+//
+// Only the given forwarding header is used, as a proxy usually only sets or overwrites one of them and
+// clients could send the others themselves. It is only used if the request was received from one of the
+// trusted proxies or through a unix socket, which has no client address and is only reachable for local
+// processes like the reverse proxy. The forwarded addresses are walked from the last to the first proxy
+// and the first address which isn't a trusted proxy is returned. An invalid address is returned if the
+// client address can't be determined.
+func clientAddr(req *http.Request, header string, trustedProxies []netip.Prefix) netip.Addr {
+	var addr netip.Addr
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); !ok || local.Network() != "unix" {
+		remote, err := netip.ParseAddrPort(req.RemoteAddr)
+		if err != nil {
+			return netip.Addr{}
+		}
+		addr = remote.Addr().Unmap()
+		if !isTrusted(addr, trustedProxies) {
+			return addr
+		}
+	}
+
+	var hops []string
+	switch header {
+	case "Forwarded":
+		hops = forwardedFor(req.Header.Values("Forwarded"))
+	case "X-Forwarded-For":
+		for _, value := range req.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	case "X-Real-IP":
+		if realIP := req.Header.Get("X-Real-IP"); realIP != "" {
+			hops = []string{realIP}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseHop(hops[i])
+		if !ok {
+			// unknown or obfuscated hops can't be checked, so the last trusted proxy is the best known client
+			break
+		}
+		addr = hop
+		if !isTrusted(addr, trustedProxies) {
+			break
+		}
+	}
+	return addr
+}
+
+func isTrusted(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the for parameters of the Forwarded header values, see RFC 7239.
+func forwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+				if strings.EqualFold(key, "for") {
+					hops = append(hops, value)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// Parses a single forwarded address, which may be quoted and may contain a port.
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if addrPort, err := netip.ParseAddrPort(hop); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// Parses the trusted proxies given as prefixes or single addresses.
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range proxies {
+		if addr, err := netip.ParseAddr(proxy); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
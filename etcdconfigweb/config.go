@@ -3,16 +3,15 @@ package main
 import (
 	"context"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
-	"strings"
 	"time"
 
 	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
@@ -25,22 +24,51 @@ type ConfigResponse struct {
 }
 
 type ConfigHandler struct {
-	tracker     RequestTracker
-	signer      Signer
-	etcdHandler *ffbs.EtcdHandler
+	tracker         RequestTracker
+	signer          Signer
+	store           ffbs.NodeStore
+	allocator       ffbs.AddressAllocator
+	stateRecorder   *ffbs.NodeStateRecorder // optional
+	trustedProxies  []netip.Prefix          // proxies whose forwarding header is used, see [clientAddr]
+	forwardedHeader string                  // one of [FORWARDED_HEADERS]
 }
 
 var MISSING_V6MTU = errors.New("Missing v6mtu query parameter")
 var MISSING_PUBKEY = errors.New("Missing pubkey query parameter")
 var MISSING_NONCE = errors.New("Missing nonce query parameter")
+var INVALID_PARAMETER = errors.New("Invalid query parameter")
 
-func (ch ConfigHandler) handleRequest(ctx context.Context, query url.Values, headers http.Header) (*ConfigResponse, error) {
+// Implemented by stores answering node lookups from memory, see [ffbs.NodeCache.LookupNodeInfo].
+type nodeLookup interface {
+	LookupNodeInfo(ctx context.Context, pubkey string) (*ffbs.NodeInfo, bool, error)
+	LookupNodeConcentrators(ctx context.Context, info *ffbs.NodeInfo) ([]ffbs.ConcentratorInfo, bool, error)
+}
+
+// Returns the node info and whether it was answered from memory, so cache hits aren't tracked as etcd reads.
+func (ch ConfigHandler) lookupNodeInfo(ctx context.Context, pubkey string) (*ffbs.NodeInfo, bool, error) {
+	if lookup, ok := ch.store.(nodeLookup); ok {
+		return lookup.LookupNodeInfo(ctx, pubkey)
+	}
+	info, err := ch.store.GetNodeInfo(ctx, pubkey)
+	return info, false, err
+}
+
+// Returns the concentrators of the node and whether they were answered from memory, see [ConfigHandler.lookupNodeInfo].
+func (ch ConfigHandler) lookupNodeConcentrators(ctx context.Context, info *ffbs.NodeInfo) ([]ffbs.ConcentratorInfo, bool, error) {
+	if lookup, ok := ch.store.(nodeLookup); ok {
+		return lookup.LookupNodeConcentrators(ctx, info)
+	}
+	concentrators, err := ch.store.GetNodeConcentrators(ctx, info)
+	return concentrators, false, err
+}
+
+func (ch ConfigHandler) handleRequest(ctx context.Context, query url.Values, client netip.Addr) (*ConfigResponse, error) {
 	var v6mtu uint64
 	var err error
 	if mtu := query["v6mtu"]; len(mtu) > 0 {
 		v6mtu, err = strconv.ParseUint(mtu[0], 10, 16)
 		if err != nil {
-			return nil, fmt.Errorf("Couldn't convert v6mtu '%s' to an integer: %w", mtu, err)
+			return nil, fmt.Errorf("%w: Couldn't convert v6mtu '%s' to an integer: %w", INVALID_PARAMETER, mtu, err)
 		}
 	} else {
 		return nil, MISSING_V6MTU
@@ -50,10 +78,10 @@ func (ch ConfigHandler) handleRequest(ctx context.Context, query url.Values, hea
 	if key := query.Get("pubkey"); key != "" {
 		pk, err := base64.StdEncoding.DecodeString(key)
 		if err != nil {
-			return nil, fmt.Errorf("Couldn't decode the provided pubkey '%s': %w", key, err)
+			return nil, fmt.Errorf("%w: Couldn't decode the provided pubkey '%s': %w", INVALID_PARAMETER, key, err)
 		}
 		if len(pk) != 32 {
-			return nil, fmt.Errorf("Expected the pubkey to have 32 bytes, but it has %d bytes instead", len(pk))
+			return nil, fmt.Errorf("%w: Expected the pubkey to have 32 bytes, but it has %d bytes instead", INVALID_PARAMETER, len(pk))
 		}
 		pubkey = base64.URLEncoding.EncodeToString(pk)
 	} else {
@@ -65,66 +93,88 @@ func (ch ConfigHandler) handleRequest(ctx context.Context, query url.Values, hea
 		return nil, MISSING_NONCE
 	}
 
-	forceIPv4 := !strings.Contains(headers.Get("X-Real-IP"), ":")
+	var ipFamily uint64 = 4
+	if client.Is6() {
+		ipFamily = 6
+	}
+
+	forceIPv4 := ipFamily == 4
 	if v6mtu < 1455 {
 		// 1375+40+8+4+4+8+16, see https://www.mail-archive.com/wireguard@lists.zx2c4.com/msg01856.html
 		forceIPv4 = true
 		log.Println("v6mtu", v6mtu, "too small, using v4")
 	}
 
-	nodeinfo, err := ch.etcdHandler.GetNodeInfo(ctx, pubkey)
+	start := time.Now()
+	nodeinfo, cached, err := ch.lookupNodeInfo(ctx, pubkey)
+	if cached {
+		ch.tracker.Observe(OPERATION_CACHE, time.Since(start))
+	} else {
+		ch.tracker.Observe(OPERATION_ETCD, time.Since(start))
+	}
 	if err != nil {
 		var notfoundError *ffbs.NodeNotFoundError
 		if !errors.As(err, &notfoundError) {
 			return nil, err
 		}
 
+		mode, err := ch.store.GetRegistrationMode(ctx)
+		if errors.Is(err, ffbs.ErrUnsupportedByFileStore) {
+			mode = ffbs.REGISTRATION_OPEN
+		} else if err != nil {
+			return nil, err
+		}
+		if mode == ffbs.REGISTRATION_APPROVAL {
+			request := ffbs.PendingNode{
+				V6MTU: &v6mtu,
+			}
+			if client.IsValid() {
+				address := client.String()
+				request.Address = &address
+			}
+			if err := ch.store.AddPendingNode(ctx, pubkey, request); err != nil {
+				return nil, err
+			}
+			ch.tracker.NodeRegistered(REGISTRATION_PENDING)
+			return nil, &ffbs.NodePendingError{
+				Pubkey: pubkey,
+			}
+		}
+
 		// insert new node
-		err := ch.etcdHandler.CreateNode(ctx, pubkey, func(info *ffbs.NodeInfo) {
-			const V4_BASE uint32 = 10 << 24
-			const V4_RANGE_SIZE uint8 = 10
-			const V6_BASE_HIGH uint64 = 0x20010bf70381 << 16
-
-			num := *info.ID
-
-			var v4Addr [net.IPv4len]byte
-			binary.BigEndian.PutUint32(v4Addr[:], V4_BASE|(uint32(num)<<V4_RANGE_SIZE))
-			v4range := fmt.Sprintf("%s/%d", net.IP(v4Addr[:]), 8*net.IPv4len-V4_RANGE_SIZE)
-			v4Addr[net.IPv4len-1] = 1
-			v4addr := net.IP(v4Addr[:]).String()
-
-			var v6Addr [net.IPv6len]byte
-			binary.BigEndian.PutUint64(v6Addr[:8], V6_BASE_HIGH|uint64(num))
-			v6range := fmt.Sprintf("%s/64", net.IP(v6Addr[:]))
-			v6Addr[net.IPv6len-1] = 1
-			v6addr := net.IP(v6Addr[:]).String()
-
-			info.Address4 = &v4addr
-			info.Range4 = &v4range
-			info.Address6 = &v6addr
-			info.Range6 = &v6range
-		})
-		if err != nil {
+		if err := ch.store.CreateNode(ctx, pubkey, ch.allocator.FillNodeInfo); err != nil {
 			return nil, err
 		}
-		nodeinfo, err = ch.etcdHandler.GetNodeInfo(ctx, pubkey)
+		ch.tracker.NodeRegistered(REGISTRATION_CREATED)
+		nodeinfo, err = ch.store.GetNodeInfo(ctx, pubkey)
 		if err != nil {
 			return nil, err
 		}
+	} else if nodeinfo.ProvisionalLease != nil {
+		// the node came back, so it isn't just a one-time request
+		if err := ch.store.ConfirmNode(ctx, pubkey); err != nil {
+			log.Println("Couldn't confirm provisional node", pubkey, ":", err)
+		}
 	}
 
-	if err := json.Unmarshal(nodeinfo.ConcentratorsJSON, &nodeinfo.Concentrators); err != nil {
+	if ch.stateRecorder != nil {
+		ch.stateRecorder.RecordRequest(pubkey, ipFamily, v6mtu)
+	}
+
+	start = time.Now()
+	nodeinfo.Concentrators, cached, err = ch.lookupNodeConcentrators(ctx, nodeinfo)
+	if cached {
+		ch.tracker.Observe(OPERATION_CACHE, time.Since(start))
+	} else {
+		ch.tracker.Observe(OPERATION_ETCD, time.Since(start))
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	concentratorBitmask := nodeinfo.SelectedConcentratorsBitmask()
 	var i uint
 	var resolver net.Resolver
 	for _, concentrator := range nodeinfo.Concentrators {
-		if (concentratorBitmask>>(concentrator.ID-1))&1 == 0 {
-			continue // Concentrator not enabled in bitmask
-		}
-
 		host, port, err := net.SplitHostPort(concentrator.Endpoint)
 		if err != nil {
 			log.Println("Error splitting concentrator endpoint host/ip", concentrator.Endpoint, ":", err)
@@ -134,7 +184,9 @@ func (ch ConfigHandler) handleRequest(ctx context.Context, query url.Values, hea
 		if forceIPv4 {
 			network = "ip4"
 		}
+		start := time.Now()
 		ip, err := resolver.LookupIP(ctx, network, host)
+		ch.tracker.Observe(OPERATION_DNS, time.Since(start))
 		if err != nil {
 			// Fail the whole response, as smth. seems to be broken on our resolve side
 			return nil, err
@@ -155,38 +207,70 @@ func (ch ConfigHandler) handleRequest(ctx context.Context, query url.Values, hea
 	}, nil
 }
 
+// Maps the errors of [ConfigHandler.handleRequest] to the HTTP status code of the response.
+func errorStatusCode(err error) int {
+	var pendingError *ffbs.NodePendingError
+	if errors.As(err, &pendingError) {
+		return http.StatusAccepted
+	}
+	var blockedError *ffbs.NodeBlockedError
+	if errors.As(err, &blockedError) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// Maps the errors of [ConfigHandler.handleRequest] to the error class of the metrics.
+func errorClass(err error) ErrorClass {
+	var pendingError *ffbs.NodePendingError
+	var blockedError *ffbs.NodeBlockedError
+	switch {
+	case errors.As(err, &pendingError):
+		return ERROR_PENDING
+	case errors.As(err, &blockedError):
+		return ERROR_BLOCKED
+	case errors.Is(err, MISSING_V6MTU), errors.Is(err, MISSING_PUBKEY), errors.Is(err, MISSING_NONCE), errors.Is(err, INVALID_PARAMETER):
+		return ERROR_INVALID_REQUEST
+	default:
+		return ERROR_BACKEND
+	}
+}
+
 func (ch ConfigHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	panicked := true
 	defer func() {
 		if panicked {
-			ch.tracker.RequestFailed()
+			ch.tracker.RequestFailed(ERROR_PANIC)
 		}
 	}()
 
-	resp, err := ch.handleRequest(req.Context(), req.URL.Query(), req.Header)
+	resp, err := ch.handleRequest(req.Context(), req.URL.Query(), clientAddr(req, ch.forwardedHeader, ch.trustedProxies))
 	if err != nil {
 		fmt.Println("Error while handling configuration request:", err)
-		w.WriteHeader(http.StatusBadRequest)
-		ch.tracker.RequestFailed()
+		w.WriteHeader(errorStatusCode(err))
+		ch.tracker.RequestFailed(errorClass(err))
 	} else {
 		w.Header().Add("Content-Type", "text/plain")
 
 		if toSign, err := json.Marshal(resp); err != nil {
 			log.Println("Couldn't encode JSON response:", err)
-			ch.tracker.RequestFailed()
+			ch.tracker.RequestFailed(ERROR_RESPONSE)
 		} else {
 			toSign = append(toSign, '\n')
-			if signature, err := ch.signer.Sign(toSign); err != nil {
+			start := time.Now()
+			signature, err := ch.signer.Sign(toSign)
+			ch.tracker.Observe(OPERATION_SIGNING, time.Since(start))
+			if err != nil {
 				log.Println("Error signing response:", err)
-				ch.tracker.RequestFailed()
+				ch.tracker.RequestFailed(ERROR_RESPONSE)
 			} else {
 				if _, err = w.Write(toSign); err != nil {
 					log.Println("Error writing json response:", err)
-					ch.tracker.RequestFailed()
+					ch.tracker.RequestFailed(ERROR_RESPONSE)
 				} else {
 					if _, err = w.Write([]byte(signature)); err != nil {
 						log.Println("Error writing signature: ", err)
-						ch.tracker.RequestFailed()
+						ch.tracker.RequestFailed(ERROR_RESPONSE)
 					} else {
 						ch.tracker.RequestSuccessful()
 					}
@@ -1,50 +1,362 @@
 /*
 etcdconfigweb provides an http interface to query and register nodes from the etcd KV store.
 
-By default it will listen on port 8080 on any interface. You can change this by passing an argument
-like ":1234", which would configure to listen on port 1234 on any interface or "127.0.0.1:1234" to only listen
-on the IPv4 local address "127.0.0.1" on port "1234".
+All settings can be passed as command-line flags (see "--help") or in a JSON file passed with "--config",
+whose keys are the flag names with underscores instead of dashes (see [Options]). Flags override the values of the file:
 
-It expects an etcd configuration file at a fixed location (see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.CreateEtcdConnection])
-and a signify private key to sign the requests at "/etc/ffbs/node-config.sec"
+	{
+	  "listen": [":8080", "[::1]:8081"],
+	  "signing_key": "/etc/ffbs/node-config.sec",
+	  "cache_staleness": "30s",
+	  "provisional_ttl": "24h"
+	}
+
+By default it will listen on port 8080 on any interface. You can change this with "--listen", e.g. ":1234"
+would configure to listen on port 1234 on any interface or "127.0.0.1:1234" to only listen on the IPv4 local
+address "127.0.0.1" on port "1234". For compatibility a single listen address may also be passed as argument.
+With "--socket-activation" the sockets passed by systemd are used instead, e.g. by an etcdconfigweb.socket unit.
+
+To serve HTTPS without a reverse proxy, pass a PEM certificate chain and key with "--tls-cert" and "--tls-key".
+All listeners use TLS in this case and HTTP/2 is offered unless disabled with "--http2=false". The files are read
+again on SIGHUP, e.g. from the deploy hook of the ACME client, and the previous certificate is kept if they are invalid.
+
+The address family of the concentrator endpoints is selected by the address of the client. Behind a reverse proxy
+the client address is taken from the header given with "--forwarded-header" (X-Real-IP by default, alternatively
+Forwarded or X-Forwarded-For), but only if the request was received from one of the trusted proxies given with
+"--trusted-proxies" (by default only the loopback addresses) or through a unix socket passed by systemd. Otherwise the
+address of the connection is used, so clients can't choose their address family by sending these headers. All other
+forwarding headers are ignored, so configure the header the reverse proxy overwrites.
+
+The server limits the duration to read requests and write responses and the size of the request headers. The etcd
+requests of a single request are cancelled after 10 seconds by default. On SIGTERM or SIGINT no new connections are
+accepted and the running requests are finished before the node states are written and the program exits.
+The etcd schema version is checked every minute by default and the server is stopped the same way with an error
+once etcd was migrated to a newer schema than supported.
+
+It expects an etcd configuration file at "/etc/etcd-client.json" (see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.CreateEtcdConnectionFromFile])
+and a signify private key to sign the requests at "/etc/ffbs/node-config.sec". To run it without etcd, pass a directory
+of JSON files with "--node-store-dir" or the FFBS_NODE_STORE_DIR environment variable (see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.FileNodeStore]).
+The node states aren't recorded in this case and all unknown nodes are created, as the files have no registration mode.
+
+New nodes get the ranges of the address plan stored in etcd (see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.EtcdHandler.GetAddressPlan]),
+which is shared with all other tools and read once at startup, so restart the service after changing it.
+
+Unknown nodes are created on their first request, unless the registration mode stored in etcd requires
+an approval (see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.REGISTRATION_APPROVAL]). In this case the request
+is only recorded and answered with the status 202 until the node is approved.
+Requests of nodes blocked by the access control lists in etcd are answered with the status 403.
+
+The concentrators in the responses are filtered by the concentrators selected for the node and by their state in the
+concentrator registry (see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.SelectConcentrators]). Draining and down concentrators
+are only handed out if no active concentrator is available for the node.
+
+The last config request of every node is recorded in the /state etcd prefix (see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.NodeStateRecorder]).
+The states are written once per minute by default to avoid an etcd write for every request.
+
+The node configurations, access control lists and the concentrator registry are cached in memory and kept up to date
+with an etcd watch (see [gitli.stratum0.org/ffbs/etcd-tools/ffbs.NodeCache]). Cached values are at most 30 seconds stale
+by default, otherwise the values are read directly from etcd.
 
 As it doesn't need any root capabilities, it should be considered to run this executable as a normal user.
 
-The HTTP server supports two endpoints:
+The HTTP server supports these endpoints:
   - /config to retrieve node configurations or create new nodes
   - /etcd_status to retrieve the current node count in etcd and the amount of successful and failed requests to the /config endpoint
+  - /metrics to retrieve the request counts by error class, the registrations, the latencies of etcd reads, node cache
+    lookups, DNS lookups and signing, and the node count in the Prometheus text format
 */
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/spf13/cobra"
 )
 
-func main() {
-	etcd, err := ffbs.CreateEtcdConnection()
+var options = defaultOptions()
+var optionsFile string
+
+var rootCmd = &cobra.Command{
+	Use:   "etcdconfigweb [listen address]",
+	Short: "HTTP interface to query and register nodes",
+	Args:  cobra.MaximumNArgs(1),
+	Run:   serve,
+}
+
+func init() {
+	rootCmd.Flags().StringVar(&optionsFile, "config", "", "JSON file with the options, flags override its values")
+	options.addFlags(rootCmd.Flags())
+}
+
+// Opens the node store selected by the options.
+func openStore(opts Options) (ffbs.NodeStore, error) {
+	if opts.NodeStoreDir != "" {
+		return &ffbs.FileNodeStore{
+			Dir: opts.NodeStoreDir,
+		}, nil
+	}
+	etcd, err := ffbs.CreateEtcdConnectionFromFile(opts.EtcdConfig)
 	if err != nil {
-		log.Fatalln("Couldn't setup etcd connection: ", err)
+		return nil, err
 	}
+	etcd.ProvisionalTTL = time.Duration(opts.ProvisionalTTL)
+	etcd.AssignedConcentrators = opts.AssignedConcentrators
+	return etcd, nil
+}
 
-	servingAddr := ":8080"
-	if len(os.Args) > 1 {
-		servingAddr = os.Args[1]
+func serve(cmd *cobra.Command, args []string) {
+	opts := options
+	if optionsFile != "" {
+		opts = defaultOptions()
+		if err := opts.load(optionsFile); err != nil {
+			log.Fatalln("Couldn't read the options file:", err)
+		}
+		opts.override(&options, cmd.Flags())
+	}
+	if len(args) > 0 {
+		// the listen address was the only option before the flags existed
+		opts.Listen = args
+	}
+
+	if opts.AssignedConcentrators < 0 {
+		log.Fatalln("Couldn't use the assigned concentrators:", opts.AssignedConcentrators, "is negative")
+	}
+	store, err := openStore(opts)
+	if err != nil {
+		log.Fatalln("Couldn't open the node store:", err)
+	}
+	if err := store.CheckSchemaVersion(context.Background()); err != nil && !errors.Is(err, ffbs.ErrUnsupportedByFileStore) {
+		log.Fatalln("Couldn't use the node store:", err)
+	}
+	plan, err := store.GetAddressPlan(context.Background())
+	if err != nil {
+		log.Fatalln("Couldn't use the address plan:", err)
 	}
 
-	signer, err := NewSignifySignerFromPrivateKeyFile("/etc/ffbs/node-config.sec")
+	signer, err := NewSignifySignerFromPrivateKeyFile(opts.SigningKey)
 	if err != nil {
 		log.Fatalln("Couldn't parse signify private key:", err)
 	}
 
-	metrics := NewMetrics(etcd)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	// the background tasks are stopped after the requests are drained, so the states of the last requests are written
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+
+	var stateRecorder *ffbs.NodeStateRecorder
+	if etcd, ok := store.(*ffbs.EtcdHandler); ok {
+		if opts.RecordState {
+			stateRecorder = etcd.NewNodeStateRecorder()
+			background.Go(func() {
+				stateRecorder.Run(backgroundCtx, time.Duration(opts.StateFlushInterval), time.Duration(opts.ShutdownTimeout))
+			})
+		}
+
+		if opts.CacheStaleness > 0 {
+			nodeCache := etcd.NewNodeCache(time.Duration(opts.CacheStaleness))
+			background.Go(func() {
+				nodeCache.Run(backgroundCtx)
+			})
+			store = nodeCache
+		}
+	}
+
+	trustedProxies, err := parseTrustedProxies(opts.TrustedProxies)
+	if err != nil {
+		log.Fatalln("Couldn't parse the trusted proxies:", err)
+	}
+	forwardedHeader, err := parseForwardedHeader(opts.ForwardedHeader)
+	if err != nil {
+		log.Fatalln("Couldn't use the forwarding header:", err)
+	}
+
+	metrics := NewMetrics(store)
+
+	mux := http.NewServeMux()
+	mux.Handle("/config", &ConfigHandler{tracker: metrics, signer: signer, store: store, allocator: plan, stateRecorder: stateRecorder, trustedProxies: trustedProxies, forwardedHeader: forwardedHeader})
+	mux.Handle("/etcd_status", metrics)
+	mux.HandleFunc("/metrics", metrics.ServePrometheus)
+
+	server := &http.Server{
+		Handler:        withTimeout(mux, time.Duration(opts.RequestTimeout)),
+		ReadTimeout:    time.Duration(opts.ReadTimeout),
+		WriteTimeout:   time.Duration(opts.WriteTimeout),
+		IdleTimeout:    time.Duration(opts.IdleTimeout),
+		MaxHeaderBytes: opts.MaxHeaderBytes,
+		Protocols:      new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+
+	useTLS := opts.TLSCert != "" || opts.TLSKey != ""
+	if useTLS {
+		certificate, err := NewCertificateReloader(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			log.Fatalln("Couldn't load the TLS certificate:", err)
+		}
+		server.TLSConfig = &tls.Config{
+			GetCertificate: certificate.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		server.Protocols.SetHTTP2(opts.HTTP2)
+		go reloadOnSIGHUP(ctx, certificate)
+	}
 
-	http.Handle("/config", &ConfigHandler{tracker: metrics, signer: signer, etcdHandler: etcd})
-	http.Handle("/etcd_status", metrics)
+	listeners, err := listen(opts)
+	if err != nil {
+		log.Fatalln("Couldn't listen:", err)
+	}
+	errs := make(chan error, len(listeners)+1)
+	background.Go(func() {
+		if err := checkSchemaVersion(backgroundCtx, store, time.Duration(opts.SchemaCheckInterval)); err != nil {
+			errs <- err
+		}
+	})
+	for _, listener := range listeners {
+		log.Println("Starting server on", listener.Addr())
+		go func() {
+			if useTLS {
+				errs <- server.ServeTLS(listener, "", "")
+			} else {
+				errs <- server.Serve(listener)
+			}
+		}()
+	}
 
-	log.Println("Starting server on", servingAddr)
-	log.Fatal("Error running webserver:", http.ListenAndServe(servingAddr, nil))
+	var serveErr error
+	select {
+	case serveErr = <-errs:
+		log.Println("Error running webserver:", serveErr)
+	case <-ctx.Done():
+		log.Println("Shutting down, waiting for running requests")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.ShutdownTimeout))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Couldn't finish all running requests:", err)
+	}
+	stopBackground()
+	background.Wait()
+
+	if serveErr != nil {
+		// let the service manager notice the failure
+		os.Exit(1)
+	}
+}
+
+// Checks the etcd schema version every interval until the context is done.
+//
+// Returns the [ffbs.SchemaTooNewError] once the schema was migrated by newer tools, as the layout can't be
+// interpreted anymore. Other errors are only logged, so a temporarily unreachable etcd doesn't stop the server.
+func checkSchemaVersion(ctx context.Context, store ffbs.NodeStore, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := store.CheckSchemaVersion(ctx)
+			var tooNew *ffbs.SchemaTooNewError
+			if errors.As(err, &tooNew) {
+				return err
+			}
+			if errors.Is(err, ffbs.ErrUnsupportedByFileStore) {
+				// the file layout isn't versioned
+				return nil
+			}
+			if err != nil {
+				log.Println("Couldn't check the schema version:", err)
+			}
+		}
+	}
+}
+
+// Reloads the TLS certificate whenever a SIGHUP is received until the context is done.
+func reloadOnSIGHUP(ctx context.Context, certificate *CertificateReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := certificate.Reload(); err != nil {
+				log.Println("Couldn't reload the TLS certificate, keeping the previous one:", err)
+			} else {
+				log.Println("Reloaded the TLS certificate")
+			}
+		}
+	}
+}
+
+var ErrNoActivatedSockets = errors.New("No sockets passed by systemd")
+var ErrNoListenAddress = errors.New("No listen address configured")
+
+// Returns the sockets passed by systemd or listens on the configured addresses.
+func listen(opts Options) ([]net.Listener, error) {
+	if opts.SocketActivation {
+		listeners, err := activation.Listeners()
+		if err == nil && len(listeners) == 0 {
+			err = ErrNoActivatedSockets
+		}
+		return listeners, err
+	}
+
+	if len(opts.Listen) == 0 {
+		return nil, ErrNoListenAddress
+	}
+	var listeners []net.Listener
+	for _, addr := range opts.Listen {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// Limits the duration of the etcd requests made while handling a request.
+func withTimeout(handler http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -3,63 +3,132 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
-type RequestTracker interface {
-	RequestSuccessful()
-	RequestFailed()
-}
+// The class of a failed request used as metric label
+type ErrorClass string
 
-type MetricEvent uint
+const (
+	ERROR_INVALID_REQUEST ErrorClass = "invalid_request" // missing or invalid query parameters
+	ERROR_PENDING         ErrorClass = "pending"         // the node awaits its approval
+	ERROR_BLOCKED         ErrorClass = "blocked"         // the node is blocked by the access control lists
+	ERROR_BACKEND         ErrorClass = "backend"         // etcd or DNS failures
+	ERROR_RESPONSE        ErrorClass = "response"        // encoding, signing or writing the response failed
+	ERROR_PANIC           ErrorClass = "panic"
+)
+
+// An operation whose latency is tracked
+type Operation string
 
 const (
-	REQUEST_SUCCESSFUL MetricEvent = iota
-	REQUEST_FAILED
+	OPERATION_ETCD    Operation = "etcd"
+	OPERATION_CACHE   Operation = "cache" // lookups answered by the node cache without an etcd request
+	OPERATION_DNS     Operation = "dns"
+	OPERATION_SIGNING Operation = "signing"
 )
 
+// The result of the registration of a new node
+type RegistrationResult string
+
+const (
+	REGISTRATION_CREATED RegistrationResult = "created"
+	REGISTRATION_PENDING RegistrationResult = "pending"
+)
+
+type RequestTracker interface {
+	RequestSuccessful()
+	RequestFailed(class ErrorClass)
+	NodeRegistered(result RegistrationResult)
+	Observe(operation Operation, duration time.Duration)
+}
+
 type NodeCounter interface {
 	NodeCount(ctx context.Context) (uint64, error)
 }
 
+// Upper bounds in seconds of the latency histogram buckets
+var LATENCY_BUCKETS = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative. The last entry counts the values above all buckets.
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(LATENCY_BUCKETS)+1)
+	}
+	i := sort.SearchFloat64s(LATENCY_BUCKETS, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
 type Metrics struct {
-	RequestsFailed     uint64
-	RequestsSuccessful uint64
+	lock          sync.Mutex
+	successful    uint64
+	failed        map[ErrorClass]uint64
+	registrations map[RegistrationResult]uint64
+	latencies     map[Operation]*histogram
 
-	events  chan MetricEvent
 	counter NodeCounter
 }
 
 func NewMetrics(counter NodeCounter) *Metrics {
-	metrics := &Metrics{
-		events:  make(chan MetricEvent, 64),
-		counter: counter,
+	return &Metrics{
+		failed:        make(map[ErrorClass]uint64),
+		registrations: make(map[RegistrationResult]uint64),
+		latencies:     make(map[Operation]*histogram),
+		counter:       counter,
 	}
-	go metrics.EventLoop()
-
-	return metrics
 }
 
 func (m *Metrics) RequestSuccessful() {
-	m.events <- REQUEST_SUCCESSFUL
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.successful++
 }
 
-func (m *Metrics) RequestFailed() {
-	m.events <- REQUEST_FAILED
+func (m *Metrics) RequestFailed(class ErrorClass) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.failed[class]++
 }
 
-func (m *Metrics) EventLoop() {
-	for event := range m.events {
-		switch event {
-		case REQUEST_SUCCESSFUL:
-			m.RequestsSuccessful += 1
-		case REQUEST_FAILED:
-			m.RequestsFailed += 1
-		default:
-			panic("Undefined/unhandled event")
-		}
+func (m *Metrics) NodeRegistered(result RegistrationResult) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.registrations[result]++
+}
+
+func (m *Metrics) Observe(operation Operation, duration time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	h, ok := m.latencies[operation]
+	if !ok {
+		h = &histogram{}
+		m.latencies[operation] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// Returns the number of successful and failed requests.
+func (m *Metrics) RequestCounts() (successful uint64, failed uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, count := range m.failed {
+		failed += count
 	}
+	return m.successful, failed
 }
 
 type MetricResponse struct {
@@ -68,6 +137,7 @@ type MetricResponse struct {
 	NodesConfigured    uint64 `json:"nodesConfigured"`
 }
 
+// Serves the /etcd_status endpoint
 func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	count, err := m.counter.NodeCount(req.Context())
 	if err != nil {
@@ -78,11 +148,93 @@ func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	w.Header().Add("Content-Type", "application/json")
 
+	successful, failed := m.RequestCounts()
 	if err := json.NewEncoder(w).Encode(&MetricResponse{
-		RequestsFailed:     m.RequestsFailed,
-		RequestsSuccessful: m.RequestsSuccessful,
+		RequestsFailed:     failed,
+		RequestsSuccessful: successful,
 		NodesConfigured:    count,
 	}); err != nil {
 		log.Println("Error while serving status request", err)
 	}
 }
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Serves the /metrics endpoint in the Prometheus text format
+//
+// If the node count can't be read, the node gauge is omitted, so the counters are still available.
+func (m *Metrics) ServePrometheus(w http.ResponseWriter, req *http.Request) {
+	var nodeCount *uint64
+	if count, err := m.counter.NodeCount(req.Context()); err != nil {
+		log.Println("Error trying to get the node count:", err)
+	} else {
+		nodeCount = &count
+	}
+
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4")
+	if err := m.writePrometheus(w, nodeCount); err != nil {
+		log.Println("Error while serving metrics request", err)
+	}
+}
+
+func (m *Metrics) writePrometheus(w io.Writer, nodeCount *uint64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var out []byte
+	printf := func(format string, args ...any) {
+		out = fmt.Appendf(out, format, args...)
+	}
+
+	printf("# HELP etcdconfigweb_requests_total Config requests by outcome and error class.\n")
+	printf("# TYPE etcdconfigweb_requests_total counter\n")
+	printf("etcdconfigweb_requests_total{outcome=\"success\"} %d\n", m.successful)
+	for _, class := range sortedKeys(m.failed) {
+		printf("etcdconfigweb_requests_total{outcome=\"failure\",error=%q} %d\n", class, m.failed[class])
+	}
+
+	printf("# HELP etcdconfigweb_registrations_total Registrations of new nodes by result.\n")
+	printf("# TYPE etcdconfigweb_registrations_total counter\n")
+	for _, result := range sortedKeys(m.registrations) {
+		printf("etcdconfigweb_registrations_total{result=%q} %d\n", result, m.registrations[result])
+	}
+
+	printf("# HELP etcdconfigweb_operation_duration_seconds Latency of the etcd reads, node cache lookups, DNS lookups and response signing.\n")
+	printf("# TYPE etcdconfigweb_operation_duration_seconds histogram\n")
+	for _, operation := range sortedKeys(m.latencies) {
+		h := m.latencies[operation]
+		var cumulative uint64
+		for i, bound := range LATENCY_BUCKETS {
+			cumulative += h.counts[i]
+			printf("etcdconfigweb_operation_duration_seconds_bucket{operation=%q,le=%q} %d\n", operation, formatFloat(bound), cumulative)
+		}
+		printf("etcdconfigweb_operation_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", operation, h.count)
+		printf("etcdconfigweb_operation_duration_seconds_sum{operation=%q} %s\n", operation, formatFloat(h.sum))
+		printf("etcdconfigweb_operation_duration_seconds_count{operation=%q} %d\n", operation, h.count)
+	}
+
+	printf("# HELP etcdconfigweb_node_count_success Whether the number of configured nodes could be read.\n")
+	printf("# TYPE etcdconfigweb_node_count_success gauge\n")
+	if nodeCount == nil {
+		printf("etcdconfigweb_node_count_success 0\n")
+	} else {
+		printf("etcdconfigweb_node_count_success 1\n")
+		printf("# HELP etcdconfigweb_nodes Number of configured nodes.\n")
+		printf("# TYPE etcdconfigweb_nodes gauge\n")
+		printf("etcdconfigweb_nodes %d\n", *nodeCount)
+	}
+
+	_, err := w.Write(out)
+	return err
+}
+
+func sortedKeys[K ~string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
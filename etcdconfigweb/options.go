@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/spf13/pflag"
+)
+
+// A duration stored as string like "30s" in the options file
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	*d = Duration(duration)
+	return err
+}
+
+// All settings of etcdconfigweb.
+//
+// The options are read from a JSON file with the keys given below and can be overridden by
+// command-line flags of the same name, with dashes instead of underscores.
+type Options struct {
+	Listen           []string `json:"listen"`            // addresses the HTTP server listens on
+	SocketActivation bool     `json:"socket_activation"` // use the sockets passed by systemd instead of the listen addresses
+	TLSCert          string   `json:"tls_cert"`          // serve HTTPS with this PEM certificate chain
+	TLSKey           string   `json:"tls_key"`           // PEM private key of the TLS certificate
+	TrustedProxies   []string `json:"trusted_proxies"`   // addresses or prefixes of the reverse proxies whose forwarding header is used
+	ForwardedHeader  string   `json:"forwarded_header"`  // the forwarding header set by the reverse proxies, see [FORWARDED_HEADERS]
+	HTTP2            bool     `json:"http2"`             // offer HTTP/2 on TLS listeners
+	SigningKey       string   `json:"signing_key"`       // signify private key used to sign the responses
+	EtcdConfig       string   `json:"etcd_config"`       // etcd client configuration, see [ffbs.EtcdConfigFile]
+	NodeStoreDir     string   `json:"node_store_dir"`    // use the JSON files in this directory instead of etcd, see [ffbs.FileNodeStore]
+
+	ReadTimeout         Duration `json:"read_timeout"`          // maximum duration to read a request
+	WriteTimeout        Duration `json:"write_timeout"`         // maximum duration from the end of the request headers to the end of the response
+	IdleTimeout         Duration `json:"idle_timeout"`          // maximum duration to wait for the next request of a keep-alive connection
+	MaxHeaderBytes      int      `json:"max_header_bytes"`      // maximum size of the request headers
+	RequestTimeout      Duration `json:"request_timeout"`       // deadline of the etcd requests of a single HTTP request
+	ShutdownTimeout     Duration `json:"shutdown_timeout"`      // maximum duration to drain the requests and to write the node states on SIGTERM or SIGINT
+	SchemaCheckInterval Duration `json:"schema_check_interval"` // interval to check whether etcd was migrated to a newer schema
+
+	CacheStaleness        Duration `json:"cache_staleness"`        // zero disables the node cache
+	RecordState           bool     `json:"record_state"`           // record the last request of every node in etcd
+	StateFlushInterval    Duration `json:"state_flush_interval"`   // interval of the node state writes
+	ProvisionalTTL        Duration `json:"provisional_ttl"`        // see [ffbs.EtcdHandler.ProvisionalTTL]
+	AssignedConcentrators int      `json:"assigned_concentrators"` // see [ffbs.EtcdHandler.AssignedConcentrators]
+}
+
+// Returns the options used if neither a file nor a flag sets them.
+func defaultOptions() Options {
+	return Options{
+		Listen:              []string{":8080"},
+		TrustedProxies:      []string{"127.0.0.0/8", "::1"},
+		ForwardedHeader:     "X-Real-IP",
+		HTTP2:               true,
+		SigningKey:          "/etc/ffbs/node-config.sec",
+		EtcdConfig:          ffbs.ETCD_CONFIG_FILE,
+		NodeStoreDir:        os.Getenv(ffbs.NODE_STORE_DIR_ENV),
+		ReadTimeout:         Duration(10 * time.Second),
+		WriteTimeout:        Duration(15 * time.Second),
+		IdleTimeout:         Duration(2 * time.Minute),
+		MaxHeaderBytes:      16 << 10,
+		RequestTimeout:      Duration(10 * time.Second),
+		ShutdownTimeout:     Duration(30 * time.Second),
+		SchemaCheckInterval: Duration(time.Minute),
+		CacheStaleness:      Duration(30 * time.Second),
+		RecordState:         true,
+		StateFlushInterval:  Duration(time.Minute),
+	}
+}
+
+// Registers a flag for every option. The flags store their values in o.
+func (o *Options) addFlags(flags *pflag.FlagSet) {
+	def := defaultOptions()
+	flags.StringSliceVar(&o.Listen, "listen", def.Listen, "addresses to listen on")
+	flags.BoolVar(&o.SocketActivation, "socket-activation", def.SocketActivation, "use the sockets passed by systemd instead of the listen addresses")
+	flags.StringVar(&o.TLSCert, "tls-cert", def.TLSCert, "serve HTTPS with this PEM certificate chain, reloaded on SIGHUP")
+	flags.StringVar(&o.TLSKey, "tls-key", def.TLSKey, "PEM private key of the TLS certificate")
+	flags.StringSliceVar(&o.TrustedProxies, "trusted-proxies", def.TrustedProxies, "addresses or prefixes of the reverse proxies whose forwarding header is used")
+	flags.StringVar(&o.ForwardedHeader, "forwarded-header", def.ForwardedHeader, "the forwarding header set by the reverse proxies: Forwarded, X-Forwarded-For or X-Real-IP")
+	flags.BoolVar(&o.HTTP2, "http2", def.HTTP2, "offer HTTP/2 on TLS listeners")
+	flags.StringVar(&o.SigningKey, "signing-key", def.SigningKey, "signify private key to sign the responses")
+	flags.StringVar(&o.EtcdConfig, "etcd-config", def.EtcdConfig, "etcd client configuration file")
+	flags.StringVar(&o.NodeStoreDir, "node-store-dir", def.NodeStoreDir, "read the nodes from the JSON files in this directory instead of etcd")
+	flags.TextVar(&o.ReadTimeout, "read-timeout", def.ReadTimeout, "maximum duration to read a request, 0s disables the timeout")
+	flags.TextVar(&o.WriteTimeout, "write-timeout", def.WriteTimeout, "maximum duration to handle a request and write the response, 0s disables the timeout")
+	flags.TextVar(&o.IdleTimeout, "idle-timeout", def.IdleTimeout, "maximum duration to keep idle connections open, 0s uses the read timeout")
+	flags.IntVar(&o.MaxHeaderBytes, "max-header-bytes", def.MaxHeaderBytes, "maximum size of the request headers")
+	flags.TextVar(&o.RequestTimeout, "request-timeout", def.RequestTimeout, "deadline of the etcd requests of a single HTTP request, 0s disables the deadline")
+	flags.TextVar(&o.ShutdownTimeout, "shutdown-timeout", def.ShutdownTimeout, "maximum duration to finish the running requests and to write the node states on SIGTERM or SIGINT")
+	flags.TextVar(&o.SchemaCheckInterval, "schema-check-interval", def.SchemaCheckInterval, "interval to check whether etcd was migrated to a newer schema, 0s disables the check")
+	flags.TextVar(&o.CacheStaleness, "cache-staleness", def.CacheStaleness, "maximum staleness of cached node configurations, 0s disables the cache")
+	flags.BoolVar(&o.RecordState, "record-state", def.RecordState, "record the last request of every node in etcd")
+	flags.TextVar(&o.StateFlushInterval, "state-flush-interval", def.StateFlushInterval, "interval in which the node states are written to etcd")
+	flags.TextVar(&o.ProvisionalTTL, "provisional-ttl", def.ProvisionalTTL, "create new nodes as provisional nodes removed after this duration unless they return")
+	flags.IntVar(&o.AssignedConcentrators, "assigned-concentrators", def.AssignedConcentrators, "number of concentrators selected for new nodes, 0 hands out all concentrators")
+}
+
+// Reads the options from a JSON file. Options missing in the file keep their value.
+func (o *Options) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(o)
+}
+
+// Copies the options of all flags set on the command line from flagged to o.
+func (o *Options) override(flagged *Options, flags *pflag.FlagSet) {
+	flags.Visit(func(flag *pflag.Flag) {
+		name := strings.ReplaceAll(flag.Name, "-", "_")
+		if dst, ok := optionField(reflect.ValueOf(o).Elem(), name); ok {
+			src, _ := optionField(reflect.ValueOf(flagged).Elem(), name)
+			dst.Set(src)
+		}
+	})
+}
+
+// Finds the field with the given JSON name in v.
+func optionField(v reflect.Value, name string) (reflect.Value, bool) {
+	for _, field := range reflect.VisibleFields(v.Type()) {
+		if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag == name {
+			return v.FieldByIndex(field.Index), true
+		}
+	}
+	return reflect.Value{}, false
+}
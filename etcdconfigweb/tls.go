@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// Serves the TLS certificate of the HTTP server and allows replacing it without a restart.
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+
+	lock sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Loads the certificate and key from the given PEM files.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	return r, r.Reload()
+}
+
+// Reads the certificate and key files again.
+//
+// If the files can't be loaded, the previous certificate is kept.
+func (r *CertificateReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	return nil
+}
+
+// Returns the current certificate, see [tls.Config.GetCertificate].
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
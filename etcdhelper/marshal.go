@@ -24,6 +24,14 @@ func UnmarshalGet(ctx context.Context, kv clientv3.KV, prefix string, dest any)
 		return 0, err
 	}
 
+	return UnmarshalResponse(resp, prefix, dest)
+}
+
+// Unmarshals an already made etcd prefix query like [UnmarshalGet].
+//
+// The keys of the response must be sorted ascending. The passed response is consumed by this function,
+// the mapped key values are removed from it.
+func UnmarshalResponse(resp *clientv3.GetResponse, prefix string, dest any) (uint, error) {
 	return unmarshalSortedGet(resp, prefix, reflect.ValueOf(dest))
 }
 
@@ -84,7 +92,9 @@ func unmarshalSortedGet(resp *clientv3.GetResponse, prefix string, dest reflect.
 
 		keyname := strings.TrimPrefix(string(kv.Key), prefix)
 		if _, ok := mapping[keyname]; !ok {
-			// key not mapped to the go struct
+			// key not mapped to the go struct (e.g. a sub prefix), skip it
+			resp.Kvs[0] = nil
+			resp.Kvs = resp.Kvs[1:]
 			continue
 		}
 		field := mapping[keyname].ResolveValue(val)
@@ -120,6 +130,13 @@ func unmarshalSortedGet(resp *clientv3.GetResponse, prefix string, dest reflect.
 			}
 			field.SetInt(val)
 			appliedValues++
+		case reflect.Float64:
+			val, err := strconv.ParseFloat(string(kv.Value), 64)
+			if err != nil {
+				return appliedValues, err
+			}
+			field.SetFloat(val)
+			appliedValues++
 		default:
 			panic("unmarshaling " + field.Kind().String() + " is not implemented")
 		}
@@ -138,7 +155,9 @@ func unmarshalSortedGet(resp *clientv3.GetResponse, prefix string, dest reflect.
 // Use the etcd tag to map a given struct field to a different name in etcd
 // or use "-" to don't map the key. E.g. `etcd:"foo"` maps a struct
 // field to the etcd key named "foo".
-func Marshal(source any, prefix string) []clientv3.Op {
+//
+// The given options are passed to every PUT operation, e.g. to attach the keys to a lease.
+func Marshal(source any, prefix string, opts ...clientv3.OpOption) []clientv3.Op {
 	val := reflect.ValueOf(source)
 	for val.Kind() == reflect.Pointer {
 		val = val.Elem()
@@ -160,7 +179,7 @@ entryloop:
 
 		switch field.Kind() {
 		case reflect.String:
-			ops = append(ops, clientv3.OpPut(prefix+key, field.String()))
+			ops = append(ops, clientv3.OpPut(prefix+key, field.String(), opts...))
 		case reflect.Slice:
 			if field.IsNil() {
 				continue entryloop
@@ -169,13 +188,16 @@ entryloop:
 				panic("currently only slices of byte/uint8 can be handled")
 			}
 			value := string(field.Interface().([]byte))
-			ops = append(ops, clientv3.OpPut(prefix+key, value))
+			ops = append(ops, clientv3.OpPut(prefix+key, value, opts...))
 		case reflect.Uint64, reflect.Uint32, reflect.Uint16, reflect.Uint8, reflect.Uint:
 			value := strconv.FormatUint(field.Uint(), 10)
-			ops = append(ops, clientv3.OpPut(prefix+key, value))
+			ops = append(ops, clientv3.OpPut(prefix+key, value, opts...))
 		case reflect.Int64, reflect.Int32, reflect.Int16, reflect.Int8, reflect.Int:
 			value := strconv.FormatInt(field.Int(), 10)
-			ops = append(ops, clientv3.OpPut(prefix+key, value))
+			ops = append(ops, clientv3.OpPut(prefix+key, value, opts...))
+		case reflect.Float64, reflect.Float32:
+			value := strconv.FormatFloat(field.Float(), 'f', -1, field.Type().Bits())
+			ops = append(ops, clientv3.OpPut(prefix+key, value, opts...))
 		default:
 			panic("marshaling " + field.Kind().String() + " is not implemented")
 		}
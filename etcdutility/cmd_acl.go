@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "acl",
+		Short: "Manages the pubkey allowlist and denylist",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "Shows the allowlist and denylist",
+		Args:  cobra.NoArgs,
+		Run:   aclList,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "deny [pubkey] [reason...]",
+		Short: "Blocks a pubkey",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			aclAdd(ffbs.ACL_DENY, args)
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "allow [pubkey] [comment...]",
+		Short: "Adds a pubkey to the allowlist",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			aclAdd(ffbs.ACL_ALLOW, args)
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:       "remove [deny|allow] [pubkey]",
+		Short:     "Removes a pubkey from the allowlist or denylist",
+		Args:      cobra.ExactArgs(2),
+		ValidArgs: []string{string(ffbs.ACL_DENY), string(ffbs.ACL_ALLOW)},
+		Run:       aclRemove,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "allowlist-only [true|false]",
+		Short: "Enables or disables that only pubkeys in the allowlist are permitted",
+		Args:  cobra.ExactArgs(1),
+		Run:   aclAllowlistOnly,
+	})
+
+	rootCmd.AddCommand(cmd)
+}
+
+func printACLList(name string, list map[string]string) {
+	pubkeys := make([]string, 0, len(list))
+	for pubkey := range list {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+
+	fmt.Println(name+":", len(list))
+	for _, pubkey := range pubkeys {
+		fmt.Println(" ", pubkey, list[pubkey])
+	}
+}
+
+func aclList(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	acl, err := etcd.GetACL(context.Background())
+	if err != nil {
+		log.Fatalln("Couldn't get the ACL:", err)
+	}
+
+	fmt.Println("Allowlist only:", acl.AllowlistOnly)
+	printACLList("Denied", acl.Denied)
+	printACLList("Allowed", acl.Allowed)
+}
+
+func aclAdd(list ffbs.ACLList, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.AddACLEntry(context.Background(), list, args[0], strings.Join(args[1:], " ")); err != nil {
+		log.Fatalln("Couldn't add ACL entry:", err)
+	}
+}
+
+func aclRemove(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.RemoveACLEntry(context.Background(), ffbs.ACLList(args[0]), args[1]); err != nil {
+		log.Fatalln("Couldn't remove ACL entry:", err)
+	}
+}
+
+func aclAllowlistOnly(cmd *cobra.Command, args []string) {
+	enabled, err := strconv.ParseBool(args[0])
+	if err != nil {
+		log.Fatalln("Couldn't parse argument:", err)
+	}
+
+	etcd := connectEtcd()
+
+	if err := etcd.SetAllowlistOnly(context.Background(), enabled); err != nil {
+		log.Fatalln("Couldn't set allowlist only mode:", err)
+	}
+}
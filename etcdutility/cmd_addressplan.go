@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "addressplan",
+		Short: "Shows or changes the address plan deriving the node ranges from the node ids",
+		Long: "Shows or changes the address plan deriving the node ranges from the node ids.\n" +
+			"An empty prefix disables the address family. Existing nodes keep their ranges, so only change\n" +
+			"the plan before creating nodes and check the nodes with fsck afterwards.",
+		Args: cobra.NoArgs,
+		Run:  addressplan,
+	}
+	cmd.Flags().String("v4-prefix", "", "prefix containing all IPv4 node ranges, empty to disable IPv4")
+	cmd.Flags().Int("v4-range-length", 0, "prefix length of a single IPv4 node range")
+	cmd.Flags().String("v6-prefix", "", "prefix containing all IPv6 node ranges, empty to disable IPv6")
+	cmd.Flags().Int("v6-range-length", 0, "prefix length of a single IPv6 node range")
+
+	rootCmd.AddCommand(cmd)
+}
+
+func addressplan(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	plan, err := etcd.GetAddressPlan(context.Background())
+	if err != nil {
+		log.Fatalln("Couldn't get the address plan:", err)
+	}
+
+	flags := cmd.Flags()
+	if flags.NFlag() > 0 {
+		if flags.Changed("v4-prefix") {
+			value, _ := flags.GetString("v4-prefix")
+			if err := plan.V4Prefix.UnmarshalText([]byte(value)); err != nil {
+				log.Fatalln("Couldn't parse the IPv4 prefix:", err)
+			}
+		}
+		if flags.Changed("v4-range-length") {
+			plan.V4RangeLength, _ = flags.GetInt("v4-range-length")
+		}
+		if flags.Changed("v6-prefix") {
+			value, _ := flags.GetString("v6-prefix")
+			if err := plan.V6Prefix.UnmarshalText([]byte(value)); err != nil {
+				log.Fatalln("Couldn't parse the IPv6 prefix:", err)
+			}
+		}
+		if flags.Changed("v6-range-length") {
+			plan.V6RangeLength, _ = flags.GetInt("v6-range-length")
+		}
+		if err := etcd.SetAddressPlan(context.Background(), plan); err != nil {
+			log.Fatalln("Couldn't set the address plan:", err)
+		}
+	}
+
+	if plan.HasIPv4() {
+		fmt.Printf("IPv4: /%d ranges in %s\n", plan.V4RangeLength, plan.V4Prefix)
+	} else {
+		fmt.Println("IPv4: disabled")
+	}
+	if plan.HasIPv6() {
+		fmt.Printf("IPv6: /%d ranges in %s\n", plan.V6RangeLength, plan.V6Prefix)
+	} else {
+		fmt.Println("IPv6: disabled")
+	}
+}
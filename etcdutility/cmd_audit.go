@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var auditSince time.Duration
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "audit [pubkey]",
+		Short: "Shows the recorded changes of a node or of all nodes",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   audit,
+	}
+	cmd.Flags().DurationVar(&auditSince, "since", 0, "only show changes within this duration, shows all changes by default")
+
+	rootCmd.AddCommand(cmd)
+}
+
+func audit(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	var pubkey string
+	if len(args) > 0 {
+		pubkey = args[0]
+	}
+	var from time.Time
+	if auditSince > 0 {
+		from = time.Now().Add(-auditSince)
+	}
+
+	records, err := etcd.GetAuditRecords(context.Background(), pubkey, from, time.Time{})
+	if err != nil {
+		log.Fatalln("Couldn't get the audit records:", err)
+	}
+
+	for _, record := range records {
+		fmt.Println(time.Unix(0, record.Time).Format(time.RFC3339), record.Pubkey, record.Action, "by", record.Actor, "using", record.Tool)
+		keys := make([]string, 0, len(record.Before)+len(record.After))
+		for key := range record.Before {
+			keys = append(keys, key)
+		}
+		for key := range record.After {
+			if _, ok := record.Before[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			before, hadBefore := record.Before[key]
+			after, hasAfter := record.After[key]
+			switch {
+			case hadBefore && hasAfter:
+				fmt.Printf("  %s: %q -> %q\n", key, before, after)
+			case hadBefore:
+				fmt.Printf("  %s: %q removed\n", key, before)
+			default:
+				fmt.Printf("  %s: %q\n", key, after)
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/spf13/cobra"
+)
+
+var concentratorValues ffbs.ConcentratorInfo
+var concentratorWeight uint64
+var rebalanceCount int
+var rebalanceApply bool
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "concentrator",
+		Short: "Manages the concentrator registry",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "Shows all concentrators",
+		Args:  cobra.NoArgs,
+		Run:   concentratorList,
+	})
+
+	add := &cobra.Command{
+		Use:   "add [id]",
+		Short: "Adds a new concentrator",
+		Args:  cobra.ExactArgs(1),
+		Run:   concentratorAdd,
+	}
+	update := &cobra.Command{
+		Use:   "update [id]",
+		Short: "Changes the given values of a concentrator",
+		Args:  cobra.ExactArgs(1),
+		Run:   concentratorUpdate,
+	}
+	for _, c := range []*cobra.Command{add, update} {
+		c.Flags().StringVar(&concentratorValues.Endpoint, "endpoint", "", "wireguard endpoint as host:port")
+		c.Flags().StringVar(&concentratorValues.PubKey, "pubkey", "", "wireguard pubkey")
+		c.Flags().StringVar(&concentratorValues.Address4, "address4", "", "IPv4 address")
+		c.Flags().StringVar(&concentratorValues.Address6, "address6", "", "IPv6 address")
+		c.Flags().Uint64Var(&concentratorWeight, "weight", 1, "relative share of nodes assigned to the concentrator")
+		cmd.AddCommand(c)
+	}
+	add.MarkFlagRequired("endpoint")
+	add.MarkFlagRequired("pubkey")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "drain [id]",
+		Short: "Marks a concentrator as draining",
+		Args:  cobra.ExactArgs(1),
+		Run:   concentratorDrain,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "activate [id]",
+		Short: "Marks a concentrator as active",
+		Args:  cobra.ExactArgs(1),
+		Run:   concentratorActivate,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "down [id]",
+		Short: "Marks a concentrator as down",
+		Args:  cobra.ExactArgs(1),
+		Run:   concentratorDown,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove [id]",
+		Short: "Removes a concentrator",
+		Args:  cobra.ExactArgs(1),
+		Run:   concentratorRemove,
+	})
+
+	rebalance := &cobra.Command{
+		Use:   "rebalance",
+		Short: "Shows or applies the changes of the selected concentrators when reassigning all nodes",
+		Args:  cobra.NoArgs,
+		Run:   concentratorRebalance,
+	}
+	rebalance.Flags().IntVar(&rebalanceCount, "count", 2, "number of concentrators assigned to each node")
+	rebalance.Flags().BoolVar(&rebalanceApply, "apply", false, "store the changed selected concentrators")
+	cmd.AddCommand(rebalance)
+
+	rootCmd.AddCommand(cmd)
+}
+
+func parseConcentratorID(arg string) uint32 {
+	id, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		log.Fatalln("Couldn't parse concentrator id:", err)
+	}
+	return uint32(id)
+}
+
+func concentratorList(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	concentrators, err := etcd.GetConcentrators(context.Background())
+	if err != nil {
+		log.Fatalln("Couldn't get the concentrators:", err)
+	}
+
+	for _, c := range concentrators {
+		fmt.Println(c.ID, c.State, "weight", c.AssignmentWeight(), c.Endpoint, c.PubKey, c.Address4, c.Address6)
+	}
+}
+
+func concentratorAdd(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	concentratorValues.ID = parseConcentratorID(args[0])
+	if cmd.Flags().Changed("weight") {
+		concentratorValues.Weight = &concentratorWeight
+	}
+	if err := etcd.AddConcentrator(context.Background(), concentratorValues); err != nil {
+		log.Fatalln("Couldn't add concentrator:", err)
+	}
+}
+
+func concentratorUpdate(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	id := parseConcentratorID(args[0])
+	concentrators, err := etcd.GetConcentrators(context.Background())
+	if err != nil {
+		log.Fatalln("Couldn't get the concentrators:", err)
+	}
+	i := slices.IndexFunc(concentrators, func(c ffbs.ConcentratorInfo) bool { return c.ID == id })
+	if i < 0 {
+		log.Fatalln("Couldn't update concentrator:", &ffbs.ConcentratorNotFoundError{ID: id})
+	}
+
+	// only the given values are changed, the empty state keeps the stored one
+	info := concentrators[i]
+	info.State = ""
+	flags := cmd.Flags()
+	if flags.Changed("endpoint") {
+		info.Endpoint = concentratorValues.Endpoint
+	}
+	if flags.Changed("pubkey") {
+		info.PubKey = concentratorValues.PubKey
+	}
+	if flags.Changed("address4") {
+		info.Address4 = concentratorValues.Address4
+	}
+	if flags.Changed("address6") {
+		info.Address6 = concentratorValues.Address6
+	}
+	if flags.Changed("weight") {
+		info.Weight = &concentratorWeight
+	}
+	if err := etcd.UpdateConcentrator(context.Background(), info); err != nil {
+		log.Fatalln("Couldn't update concentrator:", err)
+	}
+}
+
+func concentratorDrain(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.DrainConcentrator(context.Background(), parseConcentratorID(args[0])); err != nil {
+		log.Fatalln("Couldn't drain concentrator:", err)
+	}
+}
+
+func concentratorActivate(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.SetConcentratorState(context.Background(), parseConcentratorID(args[0]), ffbs.CONCENTRATOR_ACTIVE); err != nil {
+		log.Fatalln("Couldn't activate concentrator:", err)
+	}
+}
+
+func concentratorDown(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.SetConcentratorState(context.Background(), parseConcentratorID(args[0]), ffbs.CONCENTRATOR_DOWN); err != nil {
+		log.Fatalln("Couldn't mark concentrator as down:", err)
+	}
+}
+
+func concentratorRemove(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.RemoveConcentrator(context.Background(), parseConcentratorID(args[0])); err != nil {
+		log.Fatalln("Couldn't remove concentrator:", err)
+	}
+}
+
+func concentratorRebalance(cmd *cobra.Command, args []string) {
+	if rebalanceCount < 1 {
+		log.Fatalln("Couldn't rebalance concentrators:", ffbs.ErrInvalidConcentratorCount)
+	}
+	etcd := connectEtcd()
+
+	moves, err := etcd.RebalanceConcentrators(context.Background(), rebalanceCount, rebalanceApply)
+	for _, move := range moves {
+		from := "all"
+		if move.From != nil {
+			from = move.From.String()
+		}
+		fmt.Printf("%s: %s -> %s\n", move.Pubkey, from, move.To)
+	}
+	if err != nil {
+		log.Fatalln("Couldn't rebalance concentrators:", err)
+	}
+	if rebalanceApply {
+		fmt.Println("Moved nodes:", len(moves))
+	} else {
+		fmt.Println("Nodes to move:", len(moves), "(pass --apply to store the changes)")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "confirmnode [pubkey]",
+		Short: "Turns a provisional node into a permanent node",
+		Args:  cobra.ExactArgs(1),
+		Run:   confirmnode,
+	}
+
+	rootCmd.AddCommand(cmd)
+}
+
+func confirmnode(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.ConfirmNode(context.Background(), args[0]); err != nil {
+		log.Fatalln("Couldn't confirm node:", err)
+	}
+}
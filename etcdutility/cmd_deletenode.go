@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "deletenode [pubkey]",
+		Short: "Removes a node including its metadata",
+		Args:  cobra.ExactArgs(1),
+		Run:   deletenode,
+	}
+
+	rootCmd.AddCommand(cmd)
+}
+
+func deletenode(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.DeleteNode(context.Background(), args[0]); err != nil {
+		log.Fatalln("Couldn't delete node:", err)
+	}
+}
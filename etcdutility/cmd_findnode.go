@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strconv"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "findnode <address|id>",
+		Short: "Shows the node owning an IP address or node id",
+		Long:  "Shows the node owning an IP address or node id.\nAddresses are resolved using the node ranges, which include the concentrator addresses of the node.",
+		Args:  cobra.ExactArgs(1),
+		Run:   findnode,
+	}
+
+	rootCmd.AddCommand(cmd)
+}
+
+func findnode(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	var pubkey string
+	var info *ffbs.NodeInfo
+	var err error
+	if id, parseErr := strconv.ParseUint(args[0], 10, 64); parseErr == nil {
+		pubkey, info, err = etcd.FindNodeByID(context.Background(), id)
+	} else if addr, parseErr := netip.ParseAddr(args[0]); parseErr == nil {
+		pubkey, info, err = etcd.FindNodeByAddress(context.Background(), addr)
+	} else {
+		log.Fatalln("Couldn't parse the address or id:", args[0])
+	}
+	if err != nil {
+		log.Fatalln("Couldn't find the node:", err)
+	}
+
+	fmt.Println("Pubkey:", pubkey)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(info); err != nil {
+		log.Fatalln("Couldn't write the node info:", err)
+	}
+}
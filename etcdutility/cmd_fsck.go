@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/spf13/cobra"
+)
+
+var fsckRepair bool
+var fsckRenumber bool
+var fsckJSON bool
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "fsck",
+		Short: "Checks the node database for inconsistencies",
+		Long:  "Checks the node database for inconsistencies.\nThe command exits with status 1 if unrepaired findings remain.",
+		Args:  cobra.NoArgs,
+		Run:   fsck,
+	}
+	cmd.Flags().BoolVar(&fsckRepair, "repair", false, "repair the findings which can be fixed automatically")
+	cmd.Flags().BoolVar(&fsckRenumber, "renumber", false, "reallocate mismatching ranges and addresses, which changes the addresses of the nodes")
+	cmd.Flags().BoolVar(&fsckJSON, "json", false, "print the findings as JSON")
+
+	rootCmd.AddCommand(cmd)
+}
+
+func fsck(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	findings, err := etcd.Fsck(context.Background(), fsckRepair, fsckRenumber)
+	if err != nil {
+		log.Fatalln("Couldn't check the node database:", err)
+	}
+
+	if fsckJSON {
+		if findings == nil {
+			findings = []ffbs.FsckFinding{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(findings); err != nil {
+			log.Fatalln("Couldn't write the findings:", err)
+		}
+	}
+
+	unrepaired := 0
+	for _, finding := range findings {
+		if !finding.Repaired {
+			unrepaired++
+		}
+		if fsckJSON {
+			continue
+		}
+		status := ""
+		if finding.Repaired {
+			status = " (repaired)"
+		}
+		if finding.Change != "" {
+			status = fmt.Sprintf(" (repaired: %s)", finding.Change)
+		}
+		if finding.Pubkey != "" {
+			fmt.Printf("%s %s %s: %s%s\n", finding.Kind, finding.Pubkey, finding.Key, finding.Message, status)
+		} else {
+			fmt.Printf("%s %s: %s%s\n", finding.Kind, finding.Key, finding.Message, status)
+		}
+	}
+	if !fsckJSON {
+		fmt.Println("Findings:", len(findings), "unrepaired:", unrepaired)
+	}
+	if unrepaired > 0 {
+		os.Exit(1)
+	}
+}
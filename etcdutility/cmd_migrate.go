@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/spf13/cobra"
+)
+
+var migrateDryRun bool
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrates the etcd layout to the current schema version",
+		Args:  cobra.NoArgs,
+		Run:   migrate,
+	}
+	cmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "only show the pending migrations")
+
+	rootCmd.AddCommand(cmd)
+}
+
+func migrate(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	version, err := etcd.GetSchemaVersion(context.Background())
+	if err != nil {
+		log.Fatalln("Couldn't get the schema version:", err)
+	}
+	fmt.Println("Current schema version:", version)
+	fmt.Println("Supported schema version:", ffbs.SupportedSchemaVersion())
+
+	if migrateDryRun {
+		for _, migration := range ffbs.Migrations {
+			if migration.Version > version {
+				fmt.Println("Pending migration", migration.Version, ":", migration.Description)
+			}
+		}
+		return
+	}
+
+	applied, err := etcd.Migrate(context.Background())
+	for _, migration := range applied {
+		fmt.Println("Applied migration", migration.Version, ":", migration.Description)
+	}
+	if err != nil {
+		log.Fatalln("Couldn't migrate:", err)
+	}
+}
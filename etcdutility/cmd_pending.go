@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "pending",
+		Short: "Manages nodes waiting for their approval",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "Shows all nodes waiting for their approval",
+		Args:  cobra.NoArgs,
+		Run:   pendingList,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "approve [pubkey]",
+		Short: "Creates a pending node",
+		Args:  cobra.ExactArgs(1),
+		Run:   pendingApprove,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "reject [pubkey]",
+		Short: "Removes a pending node without creating it",
+		Args:  cobra.ExactArgs(1),
+		Run:   pendingReject,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:       "mode [open|approval]",
+		Short:     "Shows or sets whether new nodes need to be approved",
+		Args:      cobra.MaximumNArgs(1),
+		ValidArgs: []string{string(ffbs.REGISTRATION_OPEN), string(ffbs.REGISTRATION_APPROVAL)},
+		Run:       pendingMode,
+	})
+
+	rootCmd.AddCommand(cmd)
+}
+
+func pendingList(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	nodes, err := etcd.GetPendingNodes(context.Background())
+	if err != nil {
+		log.Fatalln("Couldn't get the pending nodes:", err)
+	}
+
+	pubkeys := make([]string, 0, len(nodes))
+	for pubkey := range nodes {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+
+	for _, pubkey := range pubkeys {
+		node := nodes[pubkey]
+		fmt.Print(pubkey)
+		if node.FirstSeen != nil {
+			fmt.Print(" first seen ", time.Unix(*node.FirstSeen, 0).Format(time.RFC3339))
+		}
+		if node.LastSeen != nil {
+			fmt.Print(" last seen ", time.Unix(*node.LastSeen, 0).Format(time.RFC3339))
+		}
+		if node.Address != nil {
+			fmt.Print(" from ", *node.Address)
+		}
+		if node.V6MTU != nil {
+			fmt.Print(" with v6mtu ", *node.V6MTU)
+		}
+		fmt.Println()
+	}
+	fmt.Println("Pending nodes:", len(nodes))
+}
+
+func pendingApprove(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	plan, err := etcd.GetAddressPlan(context.Background())
+	if err != nil {
+		log.Fatalln("Couldn't get the address plan:", err)
+	}
+	if err := etcd.ApproveNode(context.Background(), args[0], plan.FillNodeInfo); err != nil {
+		log.Fatalln("Couldn't approve node:", err)
+	}
+}
+
+func pendingReject(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.RejectNode(context.Background(), args[0]); err != nil {
+		log.Fatalln("Couldn't reject node:", err)
+	}
+}
+
+func pendingMode(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if len(args) == 0 {
+		mode, err := etcd.GetRegistrationMode(context.Background())
+		if err != nil {
+			log.Fatalln("Couldn't get the registration mode:", err)
+		}
+		fmt.Println("Registration mode:", mode)
+		return
+	}
+
+	if err := etcd.SetRegistrationMode(context.Background(), ffbs.RegistrationMode(args[0])); err != nil {
+		log.Fatalln("Couldn't set the registration mode:", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "rotatenode [pubkey] [new pubkey]",
+		Short: "Moves a node to a new pubkey keeping its addresses",
+		Args:  cobra.ExactArgs(2),
+		Run:   rotatenode,
+	}
+
+	rootCmd.AddCommand(cmd)
+}
+
+func rotatenode(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	if err := etcd.RotateNodeKey(context.Background(), args[0], args[1]); err != nil {
+		log.Fatalln("Couldn't rotate node key:", err)
+	}
+}
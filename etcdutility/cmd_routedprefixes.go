@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/netip"
+
+	"github.com/spf13/cobra"
+)
+
+var routedPrefixesClear bool
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "routedprefixes [pubkey] [prefix...]",
+		Short: "Shows or sets the additional prefixes routed to a node",
+		Long:  "Shows or sets the additional prefixes routed to a node.\nThe given prefixes replace the current ones and must be outside of the address plan. Without any prefix the current ones are shown.",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   routedprefixes,
+	}
+	cmd.Flags().BoolVar(&routedPrefixesClear, "clear", false, "remove all routed prefixes of the node")
+
+	rootCmd.AddCommand(cmd)
+}
+
+func routedprefixes(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+	pubkey := args[0]
+
+	if len(args) == 1 && !routedPrefixesClear {
+		info, err := etcd.GetOnlyNodeInfo(context.Background(), pubkey)
+		if err != nil {
+			log.Fatalln("Couldn't get the node:", err)
+		}
+		prefixes, err := info.RoutedPrefixList()
+		if err != nil {
+			log.Fatalln("Couldn't parse the routed prefixes:", err)
+		}
+		for _, prefix := range prefixes {
+			fmt.Println(prefix)
+		}
+		return
+	}
+	if len(args) > 1 && routedPrefixesClear {
+		log.Fatalln("Either pass prefixes or --clear")
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		prefix, err := netip.ParsePrefix(arg)
+		if err != nil {
+			log.Fatalln("Couldn't parse the prefix:", err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	if err := etcd.SetRoutedPrefixes(context.Background(), pubkey, prefixes); err != nil {
+		log.Fatalln("Couldn't set the routed prefixes:", err)
+	}
+}
@@ -6,8 +6,6 @@ import (
 	"log"
 	"reflect"
 
-	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
-
 	"github.com/spf13/cobra"
 )
 
@@ -22,26 +20,32 @@ func init() {
 }
 
 func showoverrides(cmd *cobra.Command, args []string) {
-	etcd, err := ffbs.CreateEtcdConnection()
-	if err != nil {
-		log.Fatalln("Couldn't setup etcd connection:", err)
-	}
+	store := connectStore()
 
-	nodes, def, err := etcd.GetAllNodeInfo(context.Background())
+	nodes, def, err := store.GetAllNodeInfo(context.Background())
 	if err != nil {
 		log.Fatalln("Couldn't get all nodes:", err)
 	}
 	defval := reflect.ValueOf(def).Elem()
 
-	unchanged := make(map[string]uint64)
+	// only optional values can be inherited from the default node
+	var fields []reflect.StructField
 	for _, field := range reflect.VisibleFields(defval.Type()) {
+		switch field.Type.Kind() {
+		case reflect.Pointer, reflect.Slice, reflect.Map:
+			fields = append(fields, field)
+		}
+	}
+
+	unchanged := make(map[string]uint64)
+	for _, field := range fields {
 		unchanged[field.Name] = 0
 	}
 
 	for pubkey, nodeinfo := range nodes {
 		nodeinfovalue := reflect.ValueOf(nodeinfo).Elem()
 
-		for _, field := range reflect.VisibleFields(defval.Type()) {
+		for _, field := range fields {
 			d := defval.FieldByIndex(field.Index)
 			v := nodeinfovalue.FieldByIndex(field.Index)
 
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
+	"github.com/spf13/cobra"
+)
+
+var importMode string
+
+func init() {
+	exportCmd := &cobra.Command{
+		Use:   "export [file]",
+		Short: "Exports the etcd configuration as JSON snapshot",
+		Long:  "Exports the etcd configuration as JSON snapshot.\nThe snapshot is written to stdout if no file is given.",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   exportSnapshot,
+	}
+	importCmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "Imports a JSON snapshot into the etcd",
+		Long:  "Imports a JSON snapshot into the etcd.\nThe snapshot is read from stdin if no file is given.",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   importSnapshot,
+	}
+	importCmd.Flags().StringVar(&importMode, "mode", string(ffbs.IMPORT_DRY_RUN), "import mode: dry-run, merge or replace")
+
+	rootCmd.AddCommand(exportCmd, importCmd)
+}
+
+func exportSnapshot(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	snapshot, err := etcd.ExportSnapshot(context.Background())
+	if err != nil {
+		log.Fatalln("Couldn't export the snapshot:", err)
+	}
+
+	out := os.Stdout
+	if len(args) == 1 {
+		out, err = os.Create(args[0])
+		if err != nil {
+			log.Fatalln("Couldn't create the snapshot file:", err)
+		}
+		defer out.Close()
+	}
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(snapshot); err != nil {
+		log.Fatalln("Couldn't write the snapshot:", err)
+	}
+}
+
+func importSnapshot(cmd *cobra.Command, args []string) {
+	var in io.Reader = os.Stdin
+	if len(args) == 1 {
+		file, err := os.Open(args[0])
+		if err != nil {
+			log.Fatalln("Couldn't open the snapshot file:", err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	var snapshot ffbs.Snapshot
+	if err := json.NewDecoder(in).Decode(&snapshot); err != nil {
+		log.Fatalln("Couldn't parse the snapshot:", err)
+	}
+
+	etcd := connectEtcd()
+
+	result, err := etcd.ImportSnapshot(context.Background(), &snapshot, ffbs.ImportMode(importMode))
+	if result != nil {
+		for _, key := range result.Put {
+			fmt.Println("put", key)
+		}
+		for _, key := range result.Deleted {
+			fmt.Println("delete", key)
+		}
+		fmt.Println(len(result.Put), "keys written,", len(result.Deleted), "keys deleted,", result.Unchanged, "keys unchanged")
+	}
+	if err != nil {
+		log.Fatalln("Couldn't import the snapshot:", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var staleSince time.Duration
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "stalenodes",
+		Short: "Shows all Pubkeys that didn't fetch their config recently",
+		Run:   stalenodes,
+	}
+	cmd.Flags().DurationVar(&staleSince, "since", 7*24*time.Hour, "duration after which a node is considered stale")
+
+	rootCmd.AddCommand(cmd)
+}
+
+func stalenodes(cmd *cobra.Command, args []string) {
+	etcd := connectEtcd()
+
+	nodes, err := etcd.GetStaleNodes(context.Background(), time.Now().Add(-staleSince))
+	if err != nil {
+		log.Fatalln("Couldn't get the stale nodes:", err)
+	}
+
+	pubkeys := make([]string, 0, len(nodes))
+	for pubkey := range nodes {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+
+	for _, pubkey := range pubkeys {
+		if lastSeen := nodes[pubkey].LastSeenTime(); lastSeen != nil {
+			fmt.Println(pubkey, "last seen", lastSeen.Format(time.RFC3339))
+		} else {
+			fmt.Println(pubkey, "never seen")
+		}
+	}
+	fmt.Println("Stale nodes:", len(nodes))
+}
@@ -1,15 +1,33 @@
 /*
-Utility for the ffbs etcd. Currently it can only show all nodes overriding a default value and
-the number of nodes affected when chaning the default value.
+Utility for the ffbs etcd. Currently it can
+  - show all nodes overriding a default value and the number of nodes affected when chaning the default value
+  - show all nodes which didn't fetch their configuration recently
+  - confirm provisional nodes
+  - delete nodes or move them to a new pubkey
+  - show the audit log of the node changes
+  - list, approve and reject nodes waiting for their approval
+  - manage the pubkey allowlist and denylist
+  - manage the concentrator registry
+  - migrate the etcd layout to the current schema version
+  - export and import snapshots of the etcd configuration
+  - check the node database for inconsistencies
+  - find the node owning an IP address or node id
+  - manage the additional prefixes routed to a node
+  - show or change the address plan of the node ranges
 
 See the help page (pass "--help" as argument) for further documentation.
 */
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log"
 	"os"
 
+	"gitli.stratum0.org/ffbs/etcd-tools/ffbs"
+
 	"github.com/spf13/cobra"
 )
 
@@ -18,6 +36,33 @@ var rootCmd = &cobra.Command{
 	Short: "Utility for some ffbs etcd management tasks",
 }
 
+// Establishes the etcd connection and ensures that the etcd schema is supported.
+//
+// The program exits if any of this fails.
+func connectEtcd() *ffbs.EtcdHandler {
+	etcd, err := ffbs.CreateEtcdConnection()
+	if err != nil {
+		log.Fatalln("Couldn't setup etcd connection:", err)
+	}
+	if err := etcd.CheckSchemaVersion(context.Background()); err != nil {
+		log.Fatalln("Couldn't use etcd:", err)
+	}
+	return etcd
+}
+
+// Opens the node store like [connectEtcd], which may be a directory of JSON files
+// instead of etcd, see [ffbs.OpenNodeStore].
+func connectStore() ffbs.NodeStore {
+	store, err := ffbs.OpenNodeStore()
+	if err != nil {
+		log.Fatalln("Couldn't open the node store:", err)
+	}
+	if err := store.CheckSchemaVersion(context.Background()); err != nil && !errors.Is(err, ffbs.ErrUnsupportedByFileStore) {
+		log.Fatalln("Couldn't use the node store:", err)
+	}
+	return store
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
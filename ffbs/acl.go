@@ -0,0 +1,154 @@
+package ffbs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// A list of pubkeys stored in the /acl/[list]/ etcd prefix.
+type ACLList string
+
+const (
+	// Pubkeys which are always blocked. The value of each entry is the reason for blocking the node.
+	ACL_DENY ACLList = "deny"
+	// Pubkeys which are allowed if [ACL_ALLOWLIST_ONLY_KEY] is enabled. The value of each entry is a free-form comment.
+	ACL_ALLOW ACLList = "allow"
+)
+
+// Indicates that an unknown ACL list was passed
+var ErrUnknownACLList = errors.New("Unknown ACL list")
+
+func (list ACLList) prefix() (string, error) {
+	switch list {
+	case ACL_DENY, ACL_ALLOW:
+		return ACL_PREFIX + string(list) + "/", nil
+	default:
+		return "", ErrUnknownACLList
+	}
+}
+
+// The pubkey access control lists stored in the /acl/ etcd prefix.
+type ACL struct {
+	Denied        map[string]string `json:"denied,omitempty"`         // pubkey to reason
+	Allowed       map[string]string `json:"allowed,omitempty"`        // pubkey to comment
+	AllowlistOnly bool              `json:"allowlist_only,omitempty"` // only nodes in Allowed are permitted
+}
+
+// Returns a [NodeBlockedError] if the node with the given pubkey isn't permitted.
+//
+// Denied nodes are always blocked, even if they are in the allowlist.
+func (acl ACL) Check(pubkey string) error {
+	if reason, ok := acl.Denied[pubkey]; ok {
+		return &NodeBlockedError{
+			Pubkey: pubkey,
+			Reason: reason,
+		}
+	}
+	if _, ok := acl.Allowed[pubkey]; acl.AllowlistOnly && !ok {
+		return &NodeBlockedError{
+			Pubkey: pubkey,
+			Reason: "not in the allowlist",
+		}
+	}
+	return nil
+}
+
+// Retrieves all access control lists.
+func (eh EtcdHandler) GetACL(ctx context.Context) (*ACL, error) {
+	resp, err := eh.KV.Get(ctx, ACL_PREFIX, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &ACL{
+		Denied:  make(map[string]string),
+		Allowed: make(map[string]string),
+	}
+	denyPrefix, _ := ACL_DENY.prefix()
+	allowPrefix, _ := ACL_ALLOW.prefix()
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		switch {
+		case key == ACL_ALLOWLIST_ONLY_KEY:
+			acl.AllowlistOnly, _ = strconv.ParseBool(string(kv.Value))
+		case strings.HasPrefix(key, denyPrefix):
+			acl.Denied[strings.TrimPrefix(key, denyPrefix)] = string(kv.Value)
+		case strings.HasPrefix(key, allowPrefix):
+			acl.Allowed[strings.TrimPrefix(key, allowPrefix)] = string(kv.Value)
+		}
+	}
+	return acl, nil
+}
+
+// Checks the access control lists for a single node without retrieving the whole lists.
+//
+// Returns a [NodeBlockedError] if the node isn't permitted.
+func (eh EtcdHandler) checkNodeACL(ctx context.Context, pubkey string) error {
+	resp, err := eh.KV.Txn(ctx).Then(nodeACLOps(pubkey)...).Commit()
+	if err != nil {
+		return err
+	}
+	return checkNodeACLResponses(pubkey, resp.Responses)
+}
+
+// Returns the etcd requests needed to check the access control lists for a single node.
+func nodeACLOps(pubkey string) []clientv3.Op {
+	denyPrefix, _ := ACL_DENY.prefix()
+	allowPrefix, _ := ACL_ALLOW.prefix()
+	return []clientv3.Op{
+		clientv3.OpGet(denyPrefix + pubkey),
+		clientv3.OpGet(allowPrefix + pubkey),
+		clientv3.OpGet(ACL_ALLOWLIST_ONLY_KEY),
+	}
+}
+
+// Checks the responses of the requests of [nodeACLOps] like [EtcdHandler.checkNodeACL].
+func checkNodeACLResponses(pubkey string, responses []*etcdserverpb.ResponseOp) error {
+	acl := ACL{
+		Denied:  make(map[string]string),
+		Allowed: make(map[string]string),
+	}
+	if kvs := responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+		acl.Denied[pubkey] = string(kvs[0].Value)
+	}
+	if kvs := responses[1].GetResponseRange().Kvs; len(kvs) > 0 {
+		acl.Allowed[pubkey] = string(kvs[0].Value)
+	}
+	if kvs := responses[2].GetResponseRange().Kvs; len(kvs) > 0 {
+		acl.AllowlistOnly, _ = strconv.ParseBool(string(kvs[0].Value))
+	}
+	return acl.Check(pubkey)
+}
+
+// Adds a pubkey to the given access control list.
+//
+// The value is the reason for [ACL_DENY] entries and a comment for [ACL_ALLOW] entries.
+func (eh EtcdHandler) AddACLEntry(ctx context.Context, list ACLList, pubkey string, value string) error {
+	prefix, err := list.prefix()
+	if err != nil {
+		return err
+	}
+	_, err = eh.KV.Put(ctx, prefix+pubkey, value)
+	return err
+}
+
+// Removes a pubkey from the given access control list.
+func (eh EtcdHandler) RemoveACLEntry(ctx context.Context, list ACLList, pubkey string) error {
+	prefix, err := list.prefix()
+	if err != nil {
+		return err
+	}
+	_, err = eh.KV.Delete(ctx, prefix+pubkey)
+	return err
+}
+
+// Enables or disables that only nodes in the [ACL_ALLOW] list are permitted.
+func (eh EtcdHandler) SetAllowlistOnly(ctx context.Context, enabled bool) error {
+	_, err := eh.KV.Put(ctx, ACL_ALLOWLIST_ONLY_KEY, strconv.FormatBool(enabled))
+	return err
+}
@@ -0,0 +1,70 @@
+package ffbs
+
+import (
+	"context"
+	"encoding/json"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Returns the address plan stored as JSON in the [ADDRESS_PLAN_KEY].
+//
+// All tools deriving node ranges use this plan, so it must only be changed before nodes are created
+// or together with a renumbering of all nodes. A missing key results in the [DefaultAddressAllocator].
+// An invalid plan returns an [ErrInvalidAddressPlan].
+func (eh EtcdHandler) GetAddressPlan(ctx context.Context) (AddressAllocator, error) {
+	resp, err := eh.KV.Get(ctx, ADDRESS_PLAN_KEY)
+	if err != nil {
+		return AddressAllocator{}, err
+	}
+	return addressPlanFromResponse(resp)
+}
+
+// Parses the address plan read with a get of [ADDRESS_PLAN_KEY], see [EtcdHandler.GetAddressPlan].
+func addressPlanFromResponse(resp *clientv3.GetResponse) (AddressAllocator, error) {
+	if len(resp.Kvs) == 0 {
+		return DefaultAddressAllocator, nil
+	}
+	return parseAddressPlan(resp.Kvs[0].Value)
+}
+
+func parseAddressPlan(value []byte) (AddressAllocator, error) {
+	var plan AddressAllocator
+	if err := json.Unmarshal(value, &plan); err != nil {
+		return AddressAllocator{}, err
+	}
+	return plan, plan.Validate()
+}
+
+// Stores the address plan used by all tools, see [EtcdHandler.GetAddressPlan].
+//
+// Existing nodes keep their ranges, use [EtcdHandler.Fsck] to find the nodes not matching the new plan.
+func (eh EtcdHandler) SetAddressPlan(ctx context.Context, plan AddressAllocator) error {
+	if err := plan.Validate(); err != nil {
+		return err
+	}
+	value, err := json.Marshal(plan)
+	if err != nil {
+		return err
+	}
+	_, err = eh.KV.Put(ctx, ADDRESS_PLAN_KEY, string(value))
+	return err
+}
+
+// Stores the plan used so far, so changing the [DefaultAddressAllocator] doesn't renumber existing networks.
+func migrateAddressPlan(ctx context.Context, eh EtcdHandler) ([]clientv3.Cmp, []clientv3.Op, error) {
+	resp, err := eh.KV.Get(ctx, ADDRESS_PLAN_KEY)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Kvs) > 0 {
+		return nil, nil, nil // already configured
+	}
+
+	value, err := json.Marshal(DefaultAddressAllocator)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []clientv3.Cmp{clientv3.Compare(clientv3.Version(ADDRESS_PLAN_KEY), "=", 0)},
+		[]clientv3.Op{clientv3.OpPut(ADDRESS_PLAN_KEY, string(value))}, nil
+}
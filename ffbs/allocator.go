@@ -0,0 +1,211 @@
+package ffbs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// Address plan deriving the IPv4 and IPv6 ranges of a node from its id.
+//
+// The node with the id n gets the n-th range of the configured range length within the
+// configured prefix. The first address of each range is used as node address.
+//
+// A family without a prefix isn't handed out at all, e.g. leave V4Prefix unset for IPv6-only networks.
+type AddressAllocator struct {
+	V4Prefix      netip.Prefix `json:"v4_prefix"`       // prefix containing all IPv4 node ranges
+	V4RangeLength int          `json:"v4_range_length"` // prefix length of a single IPv4 node range
+	V6Prefix      netip.Prefix `json:"v6_prefix"`       // prefix containing all IPv6 node ranges
+	V6RangeLength int          `json:"v6_range_length"` // prefix length of a single IPv6 node range, at most 64
+}
+
+// Returns whether IPv4 ranges are handed out.
+func (a AddressAllocator) HasIPv4() bool {
+	return a.V4Prefix.IsValid()
+}
+
+// Returns whether IPv6 ranges are handed out.
+func (a AddressAllocator) HasIPv6() bool {
+	return a.V6Prefix.IsValid()
+}
+
+// Returns the prefixes containing the node ranges of the used families.
+func (a AddressAllocator) Prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, p := range []netip.Prefix{a.V4Prefix, a.V6Prefix} {
+		if p.IsValid() {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	return prefixes
+}
+
+// Returns an [ErrInvalidAddressPlan] if the ranges of an enabled family can't be derived.
+//
+// The prefix must belong to its family and 0 < prefix length <= range length <= 30 (IPv4) or 64 (IPv6)
+// must hold. The range of a node is computed within the first 32 or 64 bits of the address and
+// must leave room for the node address and at least one concentrator address, see [ConcentratorAddress].
+func (a AddressAllocator) Validate() error {
+	if a.HasIPv4() {
+		if !a.V4Prefix.Addr().Is4() {
+			return fmt.Errorf("%w: %s is not an IPv4 prefix", ErrInvalidAddressPlan, a.V4Prefix)
+		}
+		if a.V4Prefix.Bits() == 0 || a.V4Prefix.Bits() > a.V4RangeLength || a.V4RangeLength > 30 {
+			return fmt.Errorf("%w: the IPv4 range length %d must be between the prefix length of %s and 30", ErrInvalidAddressPlan, a.V4RangeLength, a.V4Prefix)
+		}
+	}
+	if a.HasIPv6() {
+		if !a.V6Prefix.Addr().Is6() || a.V6Prefix.Addr().Is4In6() {
+			return fmt.Errorf("%w: %s is not an IPv6 prefix", ErrInvalidAddressPlan, a.V6Prefix)
+		}
+		if a.V6Prefix.Bits() == 0 || a.V6Prefix.Bits() > a.V6RangeLength || a.V6RangeLength > 64 {
+			return fmt.Errorf("%w: the IPv6 range length %d must be between the prefix length of %s and 64", ErrInvalidAddressPlan, a.V6RangeLength, a.V6Prefix)
+		}
+	}
+	return nil
+}
+
+// The address plan of Freifunk Braunschweig
+var DefaultAddressAllocator = AddressAllocator{
+	V4Prefix:      netip.MustParsePrefix("10.0.0.0/8"),
+	V4RangeLength: 22,
+	V6Prefix:      netip.MustParsePrefix("2001:bf7:381::/48"),
+	V6RangeLength: 64,
+}
+
+// Returns the IPv4 range of the node with the given id or an invalid prefix if IPv4 isn't used.
+//
+// If the id doesn't fit into the prefix, an [ErrNodeIDOutOfRange] is returned.
+func (a AddressAllocator) Range4(id uint64) (netip.Prefix, error) {
+	if !a.HasIPv4() {
+		return netip.Prefix{}, nil
+	}
+	if idBits := a.V4RangeLength - a.V4Prefix.Bits(); id>>idBits != 0 {
+		return netip.Prefix{}, fmt.Errorf("%w: id %d exceeds %s with a range length of %d", ErrNodeIDOutOfRange, id, a.V4Prefix, a.V4RangeLength)
+	}
+	base := a.V4Prefix.Masked().Addr().As4()
+	num := binary.BigEndian.Uint32(base[:]) | uint32(id)<<(32-a.V4RangeLength)
+	binary.BigEndian.PutUint32(base[:], num)
+	return netip.PrefixFrom(netip.AddrFrom4(base), a.V4RangeLength), nil
+}
+
+// Returns the IPv6 range of the node with the given id or an invalid prefix if IPv6 isn't used.
+//
+// If the id doesn't fit into the prefix, an [ErrNodeIDOutOfRange] is returned.
+func (a AddressAllocator) Range6(id uint64) (netip.Prefix, error) {
+	if !a.HasIPv6() {
+		return netip.Prefix{}, nil
+	}
+	if idBits := a.V6RangeLength - a.V6Prefix.Bits(); idBits < 64 && id>>idBits != 0 {
+		return netip.Prefix{}, fmt.Errorf("%w: id %d exceeds %s with a range length of %d", ErrNodeIDOutOfRange, id, a.V6Prefix, a.V6RangeLength)
+	}
+	base := a.V6Prefix.Masked().Addr().As16()
+	high := binary.BigEndian.Uint64(base[:8]) | id<<(64-a.V6RangeLength)
+	binary.BigEndian.PutUint64(base[:8], high)
+	return netip.PrefixFrom(netip.AddrFrom16(base), a.V6RangeLength), nil
+}
+
+// Returns the id of the node whose range contains the address.
+//
+// The second return value is false if the address is outside of the configured prefixes.
+func (a AddressAllocator) ID(addr netip.Addr) (uint64, bool) {
+	addr = addr.Unmap()
+	switch {
+	case addr.Is4() && a.V4Prefix.Contains(addr):
+		bytes := addr.As4()
+		num := binary.BigEndian.Uint32(bytes[:]) &^ (uint32(0xffffffff) << (32 - a.V4Prefix.Bits()))
+		return uint64(num >> (32 - a.V4RangeLength)), true
+	case addr.Is6() && a.V6Prefix.Contains(addr):
+		bytes := addr.As16()
+		high := binary.BigEndian.Uint64(bytes[:8]) &^ (^uint64(0) << (64 - a.V6Prefix.Bits()))
+		return high >> (64 - a.V6RangeLength), true
+	}
+	return 0, false
+}
+
+// Fills the ranges and addresses of a node based on its id.
+//
+// The values of unused families are removed. It can be directly passed to [EtcdHandler.CreateNode].
+// If the id doesn't fit into the address plan, an [ErrNodeIDOutOfRange] is returned and info is left unchanged.
+func (a AddressAllocator) FillNodeInfo(info *NodeInfo) error {
+	range4, err := a.Range4(*info.ID)
+	if err != nil {
+		return err
+	}
+	range6, err := a.Range6(*info.ID)
+	if err != nil {
+		return err
+	}
+
+	info.Address4, info.Range4 = nil, nil
+	info.Address6, info.Range6 = nil, nil
+	if range4.IsValid() {
+		v4range := range4.String()
+		v4addr := range4.Addr().Next().String()
+		info.Address4 = &v4addr
+		info.Range4 = &v4range
+	}
+	if range6.IsValid() {
+		v6range := range6.String()
+		v6addr := range6.Addr().Next().String()
+		info.Address6 = &v6addr
+		info.Range6 = &v6range
+	}
+	return nil
+}
+
+// Returns the address of the concentrator with the given id inside a node range.
+//
+// The concentrators use the last addresses of the range counting backwards by their id,
+// e.g. the concentrator 1 uses 10.0.7.254 for the node range 10.0.4.0/22 and the concentrator 2
+// uses 10.0.7.253. This way the addresses never collide with the node address at the start of the range.
+func ConcentratorAddress(nodeRange netip.Prefix, id uint32) (netip.Addr, error) {
+	hostBits := nodeRange.Addr().BitLen() - nodeRange.Bits()
+	if id == 0 || (hostBits < 34 && uint64(id)+2 >= uint64(1)<<hostBits) {
+		return netip.Addr{}, ErrConcentratorAddressOutOfRange
+	}
+
+	addr := nodeRange.Masked().Addr().As16()
+	// set all host bits to get the last address of the range
+	for i := len(addr) - 1; hostBits > 0; i-- {
+		if hostBits >= 8 {
+			addr[i] = 0xff
+		} else {
+			addr[i] |= byte(1)<<hostBits - 1
+		}
+		hostBits -= 8
+	}
+	// the id is smaller than the range size, so subtracting it doesn't touch the network bits
+	low := binary.BigEndian.Uint64(addr[8:]) - uint64(id)
+	binary.BigEndian.PutUint64(addr[8:], low)
+
+	if nodeRange.Addr().Is4() {
+		return netip.AddrFrom16(addr).Unmap(), nil
+	}
+	return netip.AddrFrom16(addr), nil
+}
+
+// Returns the addresses the node uses to reach the concentrator.
+//
+// This is the single precedence rule for concentrator addresses: a static address of the concentrator
+// is used if it is set, otherwise the address is derived from the Range4 or Range6 of the node,
+// see [ConcentratorAddress]. Families the node has no valid range for result in invalid addresses.
+func (ni NodeInfo) ConcentratorAddresses(concentrator ConcentratorInfo) (addr4 netip.Addr, addr6 netip.Addr) {
+	if ni.Range4 != nil {
+		if range4, err := netip.ParsePrefix(*ni.Range4); err == nil && range4.Addr().Is4() {
+			addr4, _ = ConcentratorAddress(range4, concentrator.ID)
+			if static, err := netip.ParseAddr(concentrator.Address4); err == nil && static.Is4() {
+				addr4 = static
+			}
+		}
+	}
+	if ni.Range6 != nil {
+		if range6, err := netip.ParsePrefix(*ni.Range6); err == nil && range6.Addr().Is6() {
+			addr6, _ = ConcentratorAddress(range6, concentrator.ID)
+			if static, err := netip.ParseAddr(concentrator.Address6); err == nil && static.Is6() {
+				addr6 = static
+			}
+		}
+	}
+	return addr4, addr6
+}
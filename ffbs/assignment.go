@@ -0,0 +1,151 @@
+package ffbs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sort"
+	"strconv"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Returns the weight of a concentrator used by [AssignConcentrators].
+func (ci ConcentratorInfo) AssignmentWeight() uint64 {
+	if ci.Weight == nil {
+		return 1
+	}
+	return *ci.Weight
+}
+
+// Returns the score of a concentrator for the given node based on weighted rendezvous hashing.
+//
+// The node gets the concentrators with the highest scores. Adding or removing a concentrator
+// only changes the assignment of the nodes having the concentrator among their best scores.
+func assignmentScore(pubkey string, concentrator ConcentratorInfo) float64 {
+	hash := sha256.Sum256([]byte(pubkey + "/" + strconv.FormatUint(uint64(concentrator.ID), 10)))
+	// map the hash to the open interval (0, 1)
+	unit := (float64(binary.BigEndian.Uint64(hash[:8])>>11) + 0.5) / (1 << 53)
+	return float64(concentrator.AssignmentWeight()) / -math.Log(unit)
+}
+
+// Picks count concentrators for the node with the given pubkey.
+//
+// Only active concentrators with a non zero weight are considered. The assignment is deterministic
+// and distributes the nodes according to the concentrator weights. If there are not enough
+// concentrators, all candidates are returned. A count below one returns an empty set.
+func AssignConcentrators(pubkey string, concentrators []ConcentratorInfo, count int) ConcentratorSet {
+	if count < 1 {
+		return ConcentratorSet{}
+	}
+
+	type candidate struct {
+		id    uint32
+		score float64
+	}
+	candidates := make([]candidate, 0, len(concentrators))
+	for _, concentrator := range concentrators {
+		if concentrator.State != CONCENTRATOR_ACTIVE && concentrator.State != "" {
+			continue
+		}
+		if concentrator.AssignmentWeight() == 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{
+			id:    concentrator.ID,
+			score: assignmentScore(pubkey, concentrator),
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	// the count may be configured far above the number of concentrators
+	count = min(count, len(candidates))
+	set := make(ConcentratorSet, count)
+	for i := 0; i < count; i++ {
+		set[candidates[i].id] = struct{}{}
+	}
+	return set
+}
+
+// A change of the selected concentrators of a node determined by [EtcdHandler.RebalanceConcentrators]
+type ConcentratorMove struct {
+	Pubkey string
+	From   ConcentratorSet // the currently selected concentrators, nil if the node uses all concentrators
+	To     ConcentratorSet
+}
+
+// Compares the selected concentrators of all nodes with the result of [AssignConcentrators]
+// and returns the differing nodes.
+//
+// If apply is set, the selected concentrators of the nodes are updated and only the applied moves
+// are returned. A node is skipped if its selected concentrators are changed concurrently. Note that
+// this also overrides manually selected concentrators, so check the returned moves before applying them.
+func (eh EtcdHandler) RebalanceConcentrators(ctx context.Context, count int, apply bool) ([]ConcentratorMove, error) {
+	if count < 1 {
+		return nil, ErrInvalidConcentratorCount
+	}
+	concentrators, err := eh.GetConcentrators(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nodes, defNode, err := eh.GetAllNodeInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pubkeys := make([]string, 0, len(nodes))
+	for pubkey := range nodes {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+
+	var moves []ConcentratorMove
+	for _, pubkey := range pubkeys {
+		node := nodes[pubkey]
+		current := node.SelectedConcentrators
+		if current == nil && defNode != nil {
+			current = defNode.SelectedConcentrators
+		}
+		var from ConcentratorSet
+		if current != nil {
+			if from, err = ParseConcentratorSet(*current); err != nil {
+				return nil, err
+			}
+		}
+
+		to := AssignConcentrators(pubkey, concentrators, count)
+		if len(to) == 0 || (from != nil && from.String() == to.String()) {
+			continue
+		}
+		move := ConcentratorMove{
+			Pubkey: pubkey,
+			From:   from,
+			To:     to,
+		}
+		if !apply {
+			moves = append(moves, move)
+			continue
+		}
+
+		skipped := false
+		err := eh.modifyNode(ctx, pubkey, AUDIT_UPDATE, func(resp *clientv3.GetResponse, values map[string]string) error {
+			value, ok := values["selected_concentrators"]
+			skipped = ok != (node.SelectedConcentrators != nil) || (ok && value != *node.SelectedConcentrators)
+			if skipped {
+				return errSkipModification // changed in the meantime
+			}
+			values["selected_concentrators"] = to.String()
+			return nil
+		})
+		if err != nil {
+			return moves, err
+		}
+		if !skipped {
+			moves = append(moves, move)
+		}
+	}
+	return moves, nil
+}
@@ -0,0 +1,129 @@
+package ffbs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Kind of a node change recorded in the audit log
+type AuditAction string
+
+const (
+	AUDIT_CREATE  AuditAction = "create"
+	AUDIT_UPDATE  AuditAction = "update"
+	AUDIT_CONFIRM AuditAction = "confirm"
+	AUDIT_DELETE  AuditAction = "delete"
+	AUDIT_ROTATE  AuditAction = "rotate"
+	AUDIT_IMPORT  AuditAction = "import"
+)
+
+// A single node change stored JSON encoded in the /audit/[pubkey]/[unix nanoseconds] etcd key.
+//
+// Before and After only contain the changed keys relative to the /config/[pubkey]/ prefix.
+type AuditRecord struct {
+	Time   int64             `json:"time"` // unix nanoseconds
+	Pubkey string            `json:"pubkey"`
+	Action AuditAction       `json:"action"`
+	Actor  string            `json:"actor,omitempty"`
+	Tool   string            `json:"tool,omitempty"`
+	Before map[string]string `json:"before,omitempty"`
+	After  map[string]string `json:"after,omitempty"`
+}
+
+func auditKey(pubkey string, t time.Time) string {
+	// zero padded to sort the keys by time
+	return fmt.Sprintf("%s%s/%019d", AUDIT_PREFIX, pubkey, t.UnixNano())
+}
+
+// Returns the operation appending an audit record for the given change.
+func (eh EtcdHandler) auditOp(pubkey string, action AuditAction, before, after map[string]string) clientv3.Op {
+	now := time.Now()
+	record := AuditRecord{
+		Time:   now.UnixNano(),
+		Pubkey: pubkey,
+		Action: action,
+		Actor:  eh.Actor,
+		Tool:   eh.Tool,
+		Before: make(map[string]string),
+		After:  make(map[string]string),
+	}
+	for key, value := range before {
+		if newValue, ok := after[key]; !ok || newValue != value {
+			record.Before[key] = value
+		}
+	}
+	for key, value := range after {
+		if oldValue, ok := before[key]; !ok || oldValue != value {
+			record.After[key] = value
+		}
+	}
+
+	// encoding a struct of strings and maps of strings doesn't fail
+	value, _ := json.Marshal(&record)
+	return clientv3.OpPut(auditKey(pubkey, now), string(value))
+}
+
+// Returns the values of the PUT operations with keys relative to the given prefix.
+func opValues(ops []clientv3.Op, prefix string) map[string]string {
+	values := make(map[string]string, len(ops))
+	for _, op := range ops {
+		if !op.IsPut() {
+			continue
+		}
+		key := string(op.KeyBytes())
+		if strings.HasPrefix(key, prefix) {
+			values[strings.TrimPrefix(key, prefix)] = string(op.ValueBytes())
+		}
+	}
+	return values
+}
+
+// Retrieves the audit records of a node within the given time range sorted by time.
+//
+// An empty pubkey returns the records of all nodes. Zero times don't limit the range.
+func (eh EtcdHandler) GetAuditRecords(ctx context.Context, pubkey string, from time.Time, to time.Time) ([]AuditRecord, error) {
+	var opts []clientv3.OpOption
+	start := AUDIT_PREFIX
+	if pubkey != "" {
+		start = AUDIT_PREFIX + pubkey + "/"
+		if !from.IsZero() {
+			start = auditKey(pubkey, from)
+		}
+		if !to.IsZero() {
+			opts = append(opts, clientv3.WithRange(auditKey(pubkey, to)))
+		} else {
+			opts = append(opts, clientv3.WithRange(clientv3.GetPrefixRangeEnd(AUDIT_PREFIX+pubkey+"/")))
+		}
+	} else {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+
+	resp, err := eh.KV.Get(ctx, start, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]AuditRecord, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var record AuditRecord
+		if err := json.Unmarshal(kv.Value, &record); err != nil {
+			return nil, fmt.Errorf("Couldn't decode audit record '%s': %w", kv.Key, err)
+		}
+		if (!from.IsZero() && record.Time < from.UnixNano()) || (!to.IsZero() && record.Time >= to.UnixNano()) {
+			continue
+		}
+		records = append(records, record)
+	}
+	if pubkey == "" {
+		sort.Slice(records, func(i, j int) bool {
+			return records[i].Time < records[j].Time
+		})
+	}
+	return records, nil
+}
@@ -0,0 +1,323 @@
+package ffbs
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Indicates that etcd closed the watch of the [NodeCache]
+var errWatchClosed = errors.New("The watch was closed")
+
+// Keeps the node configurations, the access control lists and the concentrator registry in memory
+// to answer [NodeCache.GetNodeInfo] and [NodeCache.GetNodeConcentrators] without any etcd request.
+//
+// The cache is kept up to date with an etcd watch, see [NodeCache.Run]. If the cache couldn't
+// confirm being up to date within the maximum staleness, e.g. because the watch is broken,
+// all reads are passed directly to etcd. Unknown nodes are always looked up in etcd, so nodes
+// are found right after their creation.
+//
+// Use [EtcdHandler.NewNodeCache] to create a cache.
+//
+// All other [EtcdHandler] methods are passed directly to etcd, so the cache can be used as [NodeStore].
+type NodeCache struct {
+	EtcdHandler
+	maxStaleness time.Duration
+
+	lock          sync.RWMutex
+	nodes         map[string]map[string]*mvccpb.KeyValue // pubkey (including the default node) to key to value
+	acl           map[string]string
+	concentrators map[string]*mvccpb.KeyValue
+	revision      int64
+	current       time.Time // last time the cache was known to be up to date
+}
+
+// Creates a new [NodeCache] for the etcd of the handler.
+//
+// Cached values are used for at most maxStaleness after the cache was last confirmed to be up to date.
+// The cache stays empty until [NodeCache.Run] is called, all reads are passed to etcd until then.
+func (eh EtcdHandler) NewNodeCache(maxStaleness time.Duration) *NodeCache {
+	return &NodeCache{
+		EtcdHandler:  eh,
+		maxStaleness: maxStaleness,
+	}
+}
+
+// Keeps the cache up to date until the context is done.
+//
+// The watch is restarted with a fresh copy of the values whenever it breaks.
+func (c *NodeCache) Run(ctx context.Context) {
+	if c.EtcdHandler.Watcher == nil || c.maxStaleness <= 0 {
+		log.Println("Node cache disabled: missing etcd watch client or staleness bound")
+		return
+	}
+
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := c.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Node cache watch broken, reading directly from etcd:", err)
+
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+// Loads all values and applies all changes until the watch breaks.
+func (c *NodeCache) watch(ctx context.Context) error {
+	txresp, err := c.EtcdHandler.KV.Txn(ctx).Then(
+		clientv3.OpGet(CONFIG_PREFIX, clientv3.WithPrefix()),
+		clientv3.OpGet(ACL_PREFIX, clientv3.WithPrefix()),
+		clientv3.OpGet(CONCENTRATOR_PREFIX, clientv3.WithPrefix()),
+	).Commit()
+	if err != nil {
+		return err
+	}
+
+	nodes := make(map[string]map[string]*mvccpb.KeyValue)
+	acl := make(map[string]string)
+	concentrators := make(map[string]*mvccpb.KeyValue)
+	for _, resp := range txresp.Responses {
+		for _, kv := range resp.GetResponseRange().Kvs {
+			cacheValue(nodes, acl, concentrators, kv)
+		}
+	}
+
+	c.lock.Lock()
+	c.nodes = nodes
+	c.acl = acl
+	c.concentrators = concentrators
+	c.revision = txresp.Header.Revision
+	c.current = time.Now()
+	c.lock.Unlock()
+
+	watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	// a single watch over the key range between the prefixes (the concentrator prefix is in between), so a single
+	// progress notification confirms that all are up to date. Events of other keys in this range are ignored.
+	watch := c.EtcdHandler.Watcher.Watch(watchCtx, ACL_PREFIX,
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(CONFIG_PREFIX)),
+		clientv3.WithRev(txresp.Header.Revision+1),
+	)
+
+	ticker := time.NewTicker(c.maxStaleness / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := c.EtcdHandler.Watcher.RequestProgress(watchCtx); err != nil {
+				return err
+			}
+		case resp, ok := <-watch:
+			if !ok {
+				return errWatchClosed
+			}
+			if err := resp.Err(); err != nil {
+				return err
+			}
+
+			c.lock.Lock()
+			for _, event := range resp.Events {
+				if event.Type == clientv3.EventTypeDelete {
+					uncacheValue(c.nodes, c.acl, c.concentrators, event.Kv)
+				} else {
+					cacheValue(c.nodes, c.acl, c.concentrators, event.Kv)
+				}
+			}
+			c.revision = resp.Header.Revision
+			c.current = time.Now()
+			c.lock.Unlock()
+		}
+	}
+}
+
+func cacheValue(nodes map[string]map[string]*mvccpb.KeyValue, acl map[string]string, concentrators map[string]*mvccpb.KeyValue, kv *mvccpb.KeyValue) {
+	key := string(kv.Key)
+	if strings.HasPrefix(key, ACL_PREFIX) {
+		acl[key] = string(kv.Value)
+		return
+	}
+	if strings.HasPrefix(key, CONCENTRATOR_PREFIX) {
+		concentrators[key] = kv
+		return
+	}
+	pubkey, _, ok := strings.Cut(strings.TrimPrefix(key, CONFIG_PREFIX), "/")
+	if !ok || !strings.HasPrefix(key, CONFIG_PREFIX) {
+		return
+	}
+	if nodes[pubkey] == nil {
+		nodes[pubkey] = make(map[string]*mvccpb.KeyValue)
+	}
+	nodes[pubkey][key] = kv
+}
+
+func uncacheValue(nodes map[string]map[string]*mvccpb.KeyValue, acl map[string]string, concentrators map[string]*mvccpb.KeyValue, kv *mvccpb.KeyValue) {
+	key := string(kv.Key)
+	delete(acl, key)
+	delete(concentrators, key)
+	pubkey, _, _ := strings.Cut(strings.TrimPrefix(key, CONFIG_PREFIX), "/")
+	if node, ok := nodes[pubkey]; ok {
+		delete(node, key)
+		if len(node) == 0 {
+			delete(nodes, pubkey)
+		}
+	}
+}
+
+// Returns whether the cache may be used. The read lock must be held.
+func (c *NodeCache) fresh() bool {
+	return c.nodes != nil && time.Since(c.current) <= c.maxStaleness
+}
+
+// Unmarshals the cached values of a node into info. The read lock must be held.
+func (c *NodeCache) fillNodeInfo(pubkey string, info *NodeInfo) (bool, error) {
+	node, ok := c.nodes[pubkey]
+	if !ok {
+		return false, nil
+	}
+	// the response is consumed while unmarshaling, so it must not share the cached slice
+	resp := &clientv3.GetResponse{Kvs: make([]*mvccpb.KeyValue, 0, len(node))}
+	for _, kv := range node {
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool {
+		return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key)
+	})
+	_, err := etcdhelper.UnmarshalResponse(resp, CONFIG_PREFIX+pubkey+"/", info)
+	return true, err
+}
+
+// Get the default node info like [EtcdHandler.GetDefaultNodeInfo].
+func (c *NodeCache) GetDefaultNodeInfo(ctx context.Context) (*NodeInfo, error) {
+	c.lock.RLock()
+	if c.fresh() {
+		defer c.lock.RUnlock()
+		info := &NodeInfo{
+			Revision: c.revision,
+		}
+		found, err := c.fillNodeInfo(DEFAULT_NODE_KEY, info)
+		if err == nil && !found {
+			err = &NodeNotFoundError{
+				Pubkey: DEFAULT_NODE_KEY,
+			}
+		}
+		return info, err
+	}
+	c.lock.RUnlock()
+	return c.EtcdHandler.GetDefaultNodeInfo(ctx)
+}
+
+// Get the node info for a given Wireguard pubkey like [EtcdHandler.GetNodeInfo].
+//
+// Nodes which aren't cached are read directly from etcd.
+func (c *NodeCache) GetNodeInfo(ctx context.Context, pubkey string) (*NodeInfo, error) {
+	info, _, err := c.LookupNodeInfo(ctx, pubkey)
+	return info, err
+}
+
+// Implements [NodeCache.GetNodeInfo] and additionally returns whether the cache answered without an etcd request.
+func (c *NodeCache) LookupNodeInfo(ctx context.Context, pubkey string) (*NodeInfo, bool, error) {
+	c.lock.RLock()
+	if c.fresh() {
+		info, ok, err := c.cachedNodeInfo(pubkey)
+		c.lock.RUnlock()
+		if ok {
+			return info, true, err
+		}
+	} else {
+		c.lock.RUnlock()
+	}
+	info, err := c.EtcdHandler.GetNodeInfo(ctx, pubkey)
+	return info, false, err
+}
+
+// Returns the concentrators the given node should use like [EtcdHandler.GetNodeConcentrators].
+func (c *NodeCache) GetNodeConcentrators(ctx context.Context, info *NodeInfo) ([]ConcentratorInfo, error) {
+	concentrators, _, err := c.LookupNodeConcentrators(ctx, info)
+	return concentrators, err
+}
+
+// Implements [NodeCache.GetNodeConcentrators] and additionally returns whether the cache answered without an etcd request.
+func (c *NodeCache) LookupNodeConcentrators(ctx context.Context, info *NodeInfo) ([]ConcentratorInfo, bool, error) {
+	c.lock.RLock()
+	if !c.fresh() {
+		c.lock.RUnlock()
+		concentrators, err := c.EtcdHandler.GetNodeConcentrators(ctx, info)
+		return concentrators, false, err
+	}
+	resp := &clientv3.GetResponse{Kvs: make([]*mvccpb.KeyValue, 0, len(c.concentrators))}
+	for _, kv := range c.concentrators {
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	var defaultJSON []byte
+	if kv, ok := c.nodes[DEFAULT_NODE_KEY][CONFIG_PREFIX+DEFAULT_NODE_KEY+"/concentrators"]; ok {
+		defaultJSON = kv.Value
+	}
+	c.lock.RUnlock()
+
+	sort.Slice(resp.Kvs, func(i, j int) bool {
+		return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key)
+	})
+	concentrators, err := concentratorsFromResponse(resp)
+	if err != nil {
+		return nil, true, err
+	}
+	concentrators, err = registryNodeConcentrators(info, concentrators, defaultJSON)
+	return concentrators, true, err
+}
+
+// Implements [NodeCache.GetNodeInfo] using the cached values. The read lock must be held.
+func (c *NodeCache) cachedNodeInfo(pubkey string) (*NodeInfo, bool, error) {
+	denyPrefix, _ := ACL_DENY.prefix()
+	allowPrefix, _ := ACL_ALLOW.prefix()
+	acl := ACL{
+		Denied:  make(map[string]string),
+		Allowed: make(map[string]string),
+	}
+	if reason, ok := c.acl[denyPrefix+pubkey]; ok {
+		acl.Denied[pubkey] = reason
+	}
+	if comment, ok := c.acl[allowPrefix+pubkey]; ok {
+		acl.Allowed[pubkey] = comment
+	}
+	acl.AllowlistOnly, _ = strconv.ParseBool(c.acl[ACL_ALLOWLIST_ONLY_KEY])
+	if err := acl.Check(pubkey); err != nil {
+		return nil, true, err
+	}
+
+	if _, ok := c.nodes[pubkey]; !ok {
+		return nil, false, nil
+	}
+	info := &NodeInfo{
+		Revision: c.revision,
+	}
+	if _, err := c.fillNodeInfo(DEFAULT_NODE_KEY, info); err != nil {
+		return nil, true, err
+	}
+	if _, err := c.fillNodeInfo(pubkey, info); err != nil {
+		return nil, true, err
+	}
+	return info, true, nil
+}
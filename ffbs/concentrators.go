@@ -0,0 +1,245 @@
+package ffbs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"sort"
+	"strconv"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+func concentratorPrefix(id uint32) string {
+	return CONCENTRATOR_PREFIX + strconv.FormatUint(uint64(id), 10) + "/"
+}
+
+// Retrieves all concentrators of the concentrator registry sorted by their id.
+func (eh EtcdHandler) GetConcentrators(ctx context.Context) ([]ConcentratorInfo, error) {
+	resp, err := eh.KV.Get(ctx, CONCENTRATOR_PREFIX, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	return concentratorsFromResponse(resp)
+}
+
+// Unmarshals the concentrator registry read with a prefix get of [CONCENTRATOR_PREFIX].
+func concentratorsFromResponse(resp *clientv3.GetResponse) ([]ConcentratorInfo, error) {
+	list := make(map[string]*ConcentratorInfo)
+	if _, err := etcdhelper.UnmarshalResponse(resp, CONCENTRATOR_PREFIX, &list); err != nil {
+		return nil, err
+	}
+
+	concentrators := make([]ConcentratorInfo, 0, len(list))
+	for key, concentrator := range list {
+		id, err := strconv.ParseUint(key, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		concentrator.ID = uint32(id)
+		if concentrator.State == "" {
+			concentrator.State = CONCENTRATOR_ACTIVE
+		}
+		concentrators = append(concentrators, *concentrator)
+	}
+	sort.Slice(concentrators, func(i, j int) bool {
+		return concentrators[i].ID < concentrators[j].ID
+	})
+	return concentrators, nil
+}
+
+// Returns the concentrators the given node should use.
+//
+// The concentrators are taken from the concentrator registry. If the registry is empty or the node
+// overrides the JSON encoded concentrators of the default node, the JSON encoded concentrators of
+// the node info are used instead. Afterwards they are filtered with the selected concentrators and
+// the concentrator states, see [SelectConcentrators].
+//
+// The addresses of the concentrators are replaced by the ones the node should use, see [NodeInfo.ConcentratorAddresses].
+func (eh EtcdHandler) GetNodeConcentrators(ctx context.Context, info *NodeInfo) ([]ConcentratorInfo, error) {
+	defaultKey := CONFIG_PREFIX + DEFAULT_NODE_KEY + "/concentrators"
+	txresp, err := eh.KV.Txn(ctx).Then(
+		clientv3.OpGet(CONCENTRATOR_PREFIX, clientv3.WithPrefix()),
+		clientv3.OpGet(defaultKey),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultJSON []byte
+	if kvs := txresp.Responses[1].GetResponseRange().Kvs; len(kvs) > 0 {
+		defaultJSON = kvs[0].Value
+	}
+	concentrators, err := concentratorsFromResponse((*clientv3.GetResponse)(txresp.Responses[0].GetResponseRange()))
+	if err != nil {
+		return nil, err
+	}
+	return registryNodeConcentrators(info, concentrators, defaultJSON)
+}
+
+// Implements [EtcdHandler.GetNodeConcentrators] for the concentrator registry and the JSON encoded
+// concentrators of the default node.
+func registryNodeConcentrators(info *NodeInfo, concentrators []ConcentratorInfo, defaultJSON []byte) ([]ConcentratorInfo, error) {
+	// concentrators configured for a single node predate the registry and stay in effect
+	overridden := len(info.ConcentratorsJSON) > 0 && !bytes.Equal(info.ConcentratorsJSON, defaultJSON)
+	if len(concentrators) == 0 || overridden {
+		concentrators = nil
+		if err := json.Unmarshal(info.ConcentratorsJSON, &concentrators); err != nil {
+			return nil, err
+		}
+	}
+	return nodeConcentrators(info, concentrators)
+}
+
+// Selects the concentrators of the node and fills their missing addresses, see [EtcdHandler.GetNodeConcentrators].
+func nodeConcentrators(info *NodeInfo, concentrators []ConcentratorInfo) ([]ConcentratorInfo, error) {
+	selected, err := info.SelectedConcentratorSet()
+	if err != nil {
+		return nil, err
+	}
+
+	concentrators = SelectConcentrators(concentrators, selected)
+	for i := range concentrators {
+		addr4, addr6 := info.ConcentratorAddresses(concentrators[i])
+		concentrators[i].Address4, concentrators[i].Address6 = "", ""
+		if addr4.IsValid() {
+			concentrators[i].Address4 = addr4.String()
+		}
+		if addr6.IsValid() {
+			concentrators[i].Address6 = addr6.String()
+		}
+	}
+	return concentrators, nil
+}
+
+// Returns the concentrators from the list a node with the given selected concentrators should use.
+//
+// Only active concentrators of the selection are used. To keep at least one concentrator for every
+// node, the following fallbacks are used if there is no active selected concentrator:
+//  1. the draining concentrators of the selection
+//  2. the active concentrators outside of the selection
+//  3. all selected concentrators regardless of their state
+func SelectConcentrators(concentrators []ConcentratorInfo, selected ConcentratorSet) []ConcentratorInfo {
+	var active, draining, unselected, all []ConcentratorInfo
+	for _, concentrator := range concentrators {
+		state := concentrator.State
+		if state == "" {
+			state = CONCENTRATOR_ACTIVE
+		}
+
+		if !selected.Contains(concentrator.ID) {
+			if state == CONCENTRATOR_ACTIVE {
+				unselected = append(unselected, concentrator)
+			}
+			continue
+		}
+
+		all = append(all, concentrator)
+		switch state {
+		case CONCENTRATOR_ACTIVE:
+			active = append(active, concentrator)
+		case CONCENTRATOR_DRAINING:
+			draining = append(draining, concentrator)
+		}
+	}
+
+	for _, candidates := range [][]ConcentratorInfo{active, draining, unselected} {
+		if len(candidates) > 0 {
+			return candidates
+		}
+	}
+	return all
+}
+
+// Adds a new concentrator to the concentrator registry.
+//
+// If a concentrator with the same id exists, [ErrConcentratorExists] is returned.
+// An empty state is stored as [CONCENTRATOR_ACTIVE].
+func (eh EtcdHandler) AddConcentrator(ctx context.Context, info ConcentratorInfo) error {
+	if info.ID == 0 {
+		return ErrInvalidConcentratorID
+	}
+	if info.State == "" {
+		info.State = CONCENTRATOR_ACTIVE
+	}
+
+	prefix := concentratorPrefix(info.ID)
+	missing := clientv3.Compare(clientv3.CreateRevision(prefix+"pubkey"), "=", 0)
+	txresp, err := eh.KV.Txn(ctx).If(missing).Then(etcdhelper.Marshal(&info, prefix)...).Commit()
+	if err != nil {
+		return err
+	}
+	if !txresp.Succeeded {
+		return ErrConcentratorExists
+	}
+	return nil
+}
+
+// Replaces the values of an existing concentrator in the concentrator registry.
+//
+// If the concentrator doesn't exist, a [ConcentratorNotFoundError] is returned.
+// An empty state keeps the stored state, use [EtcdHandler.SetConcentratorState] to change it.
+func (eh EtcdHandler) UpdateConcentrator(ctx context.Context, info ConcentratorInfo) error {
+	prefix := concentratorPrefix(info.ID)
+	ops := etcdhelper.Marshal(&info, prefix)
+	if info.State == "" {
+		ops = slices.DeleteFunc(ops, func(op clientv3.Op) bool {
+			return string(op.KeyBytes()) == prefix+"state"
+		})
+	}
+	return eh.updateConcentrator(ctx, info.ID, ops)
+}
+
+// Marks a concentrator as draining to prepare its removal.
+//
+// If the concentrator doesn't exist, a [ConcentratorNotFoundError] is returned.
+func (eh EtcdHandler) DrainConcentrator(ctx context.Context, id uint32) error {
+	return eh.SetConcentratorState(ctx, id, CONCENTRATOR_DRAINING)
+}
+
+// Sets the state of a concentrator in the concentrator registry.
+//
+// If the concentrator doesn't exist, a [ConcentratorNotFoundError] is returned.
+func (eh EtcdHandler) SetConcentratorState(ctx context.Context, id uint32, state ConcentratorState) error {
+	switch state {
+	case CONCENTRATOR_ACTIVE, CONCENTRATOR_DRAINING, CONCENTRATOR_DOWN:
+	default:
+		return ErrUnknownConcentratorState
+	}
+	return eh.updateConcentrator(ctx, id, []clientv3.Op{
+		clientv3.OpPut(concentratorPrefix(id)+"state", string(state)),
+	})
+}
+
+func (eh EtcdHandler) updateConcentrator(ctx context.Context, id uint32, ops []clientv3.Op) error {
+	exists := clientv3.Compare(clientv3.CreateRevision(concentratorPrefix(id)+"pubkey"), ">", 0)
+	txresp, err := eh.KV.Txn(ctx).If(exists).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !txresp.Succeeded {
+		return &ConcentratorNotFoundError{
+			ID: id,
+		}
+	}
+	return nil
+}
+
+// Removes a concentrator from the concentrator registry.
+//
+// If the concentrator doesn't exist, a [ConcentratorNotFoundError] is returned.
+func (eh EtcdHandler) RemoveConcentrator(ctx context.Context, id uint32) error {
+	resp, err := eh.KV.Delete(ctx, concentratorPrefix(id), clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return &ConcentratorNotFoundError{
+			ID: id,
+		}
+	}
+	return nil
+}
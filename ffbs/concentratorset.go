@@ -0,0 +1,76 @@
+package ffbs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A set of concentrator ids as stored space separated in the selected_concentrators key.
+//
+// The nil set contains all concentrators.
+type ConcentratorSet map[uint32]struct{}
+
+// Parses a space separated list of concentrator ids.
+//
+// An empty list results in the nil set containing all concentrators.
+func ParseConcentratorSet(list string) (ConcentratorSet, error) {
+	fields := strings.Fields(list)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	set := make(ConcentratorSet, len(fields))
+	for _, field := range fields {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse concentrator id '%s': %w", field, err)
+		}
+		set[uint32(id)] = struct{}{}
+	}
+	return set, nil
+}
+
+// Returns the concentrator set containing exactly the given ids.
+func NewConcentratorSet(ids ...uint32) ConcentratorSet {
+	set := make(ConcentratorSet, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+// Reports whether the concentrator with the given id is part of the set.
+func (cs ConcentratorSet) Contains(id uint32) bool {
+	if cs == nil {
+		return true
+	}
+	_, ok := cs[id]
+	return ok
+}
+
+// Returns the sorted ids of the set. The nil set returns nil.
+func (cs ConcentratorSet) IDs() []uint32 {
+	if cs == nil {
+		return nil
+	}
+	ids := make([]uint32, 0, len(cs))
+	for id := range cs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// Formats the set as sorted space separated list, as stored in the selected_concentrators key.
+func (cs ConcentratorSet) String() string {
+	ids := cs.IDs()
+	fields := make([]string, len(ids))
+	for i, id := range ids {
+		fields[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(fields, " ")
+}
@@ -3,3 +3,18 @@ package ffbs
 const CONFIG_PREFIX = "/config/"
 const DEFAULT_NODE_KEY = "default"
 const NEXT_FREE_ID_KEY = "next_free_id"
+const META_PREFIX = "meta/"
+const STATE_PREFIX = "/state/"
+const PROVISIONAL_PREFIX = "/provisional/"
+const PROVISIONAL_LEASE_KEY = "provisional_lease"
+const PENDING_PREFIX = "/pending/"
+const REGISTRATION_MODE_KEY = "registration_mode"
+const ACL_PREFIX = "/acl/"
+const ACL_ALLOWLIST_ONLY_KEY = ACL_PREFIX + "allowlist_only"
+const CONCENTRATOR_PREFIX = "/concentrators/"
+const SCHEMA_VERSION_KEY = "/schema_version"
+const AUDIT_PREFIX = "/audit/"
+const ID_INDEX_PREFIX = "/ids/"
+const ADDRESS_PLAN_KEY = "/address_plan"
+const NODE_STORE_DIR_ENV = "FFBS_NODE_STORE_DIR"
+const ETCD_CONFIG_FILE = "/etc/etcd-client.json"
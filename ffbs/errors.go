@@ -1,7 +1,9 @@
 package ffbs
 
 import (
+	"errors"
 	"fmt"
+	"net/netip"
 )
 
 type NodeNotFoundError struct {
@@ -11,3 +13,83 @@ type NodeNotFoundError struct {
 func (err *NodeNotFoundError) Error() string {
 	return fmt.Sprintf("The node with the pubkey '%s' is not in etcd", err.Pubkey)
 }
+
+type NodeIDNotFoundError struct {
+	ID uint64
+}
+
+func (err *NodeIDNotFoundError) Error() string {
+	return fmt.Sprintf("The node with the id %d is not in etcd", err.ID)
+}
+
+type NodeAddressNotFoundError struct {
+	Address netip.Addr
+}
+
+func (err *NodeAddressNotFoundError) Error() string {
+	return fmt.Sprintf("No node range contains the address %s", err.Address)
+}
+
+type NodePendingError struct {
+	Pubkey string
+}
+
+func (err *NodePendingError) Error() string {
+	return fmt.Sprintf("The node with the pubkey '%s' is waiting for its approval", err.Pubkey)
+}
+
+// Indicates that provisional nodes should be created, but the [EtcdHandler] has no lease client
+var ErrMissingLease = errors.New("Provisional nodes require an etcd lease client")
+
+// Indicates that a precondition of a node change wasn't met, e.g. because it was changed concurrently
+var ErrConditionFailed = errors.New("The node was modified concurrently")
+
+type NodeBlockedError struct {
+	Pubkey string
+	Reason string
+}
+
+func (err *NodeBlockedError) Error() string {
+	return fmt.Sprintf("The node with the pubkey '%s' is blocked: %s", err.Pubkey, err.Reason)
+}
+
+type ConcentratorNotFoundError struct {
+	ID uint32
+}
+
+func (err *ConcentratorNotFoundError) Error() string {
+	return fmt.Sprintf("The concentrator with the id %d is not in etcd", err.ID)
+}
+
+// Indicates that a concentrator with the same id is already in the registry
+var ErrConcentratorExists = errors.New("The concentrator already exists")
+
+// Indicates that a concentrator id of 0 was used
+var ErrInvalidConcentratorID = errors.New("The concentrator id must not be 0")
+
+// Indicates that an unknown concentrator state was passed
+var ErrUnknownConcentratorState = errors.New("Unknown concentrator state")
+
+// Indicates that less than one concentrator should be assigned to the nodes
+var ErrInvalidConcentratorCount = errors.New("At least one concentrator must be assigned")
+
+// Indicates that the ranges of an [AddressAllocator] can't be derived, see [AddressAllocator.Validate]
+var ErrInvalidAddressPlan = errors.New("Invalid address plan")
+
+// Indicates that the ranges of a node id would exceed the prefixes of the address plan
+var ErrNodeIDOutOfRange = errors.New("The node id doesn't fit into the address plan")
+
+// Indicates that a routed prefix overlaps the prefixes the node ranges are allocated from
+var ErrPrefixInAddressPlan = errors.New("The prefix overlaps the address plan")
+
+// Indicates that a concentrator id doesn't fit into the node range
+var ErrConcentratorAddressOutOfRange = errors.New("The concentrator id doesn't fit into the node range")
+
+type SchemaTooNewError struct {
+	Version   uint64
+	Supported uint64
+}
+
+func (err *SchemaTooNewError) Error() string {
+	return fmt.Sprintf("The etcd schema version %d is newer than the supported version %d, please update the tools", err.Version, err.Supported)
+}
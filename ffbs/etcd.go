@@ -6,12 +6,14 @@ import (
 	"encoding/json"
 	"io"
 	"os"
+	"os/user"
+	"path/filepath"
 	"strings"
 
 	"go.etcd.io/etcd/client/v3"
 )
 
-// Representing the JSON values stored in /etc/etcd-client.json .
+// Representing the JSON values stored in the [ETCD_CONFIG_FILE].
 type EtcdConfigFile struct {
 	Endpoints string // comma separated
 	CACert    string
@@ -20,13 +22,20 @@ type EtcdConfigFile struct {
 }
 
 // Establishes an etcd connection with the configuration
-// under /etc/etcd-client.json .
+// under /etc/etcd-client.json , see [CreateEtcdConnectionFromFile].
+func CreateEtcdConnection() (*EtcdHandler, error) {
+	return CreateEtcdConnectionFromFile(ETCD_CONFIG_FILE)
+}
+
+// Establishes an etcd connection with the configuration in the given file.
 //
 // This function will only allow the configured CACert and
 // ignores system root certificate authorities when connecting
 // to the etcd server.
-func CreateEtcdConnection() (*EtcdHandler, error) {
-	f, err := os.Open("/etc/etcd-client.json")
+//
+// The current user and program name are used as actor and tool for the audit log.
+func CreateEtcdConnectionFromFile(file string) (*EtcdHandler, error) {
+	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +71,16 @@ func CreateEtcdConnection() (*EtcdHandler, error) {
 		},
 	})
 
+	actor := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		actor = u.Username
+	}
+
 	return &EtcdHandler{
-		KV: kv,
+		KV:      kv,
+		Lease:   kv,
+		Watcher: kv,
+		Actor:   actor,
+		Tool:    filepath.Base(os.Args[0]),
 	}, err
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"regexp"
 	"strconv"
+	"time"
 
 	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
 
@@ -13,13 +14,37 @@ import (
 
 // Implements all Freifunk Braunschweig specific etcd interactions to keep the etcd
 // specific details away from the application logic.
+//
+// All node changes are recorded in the audit log with the Actor and Tool of the handler, see [AuditRecord].
 type EtcdHandler struct {
-	KV clientv3.KV
+	KV      clientv3.KV
+	Lease   clientv3.Lease   // only required for provisional nodes
+	Watcher clientv3.Watcher // only required for the [NodeCache]
+
+	Actor string // user responsible for the changes
+	Tool  string // program making the changes
+
+	// If non zero, [EtcdHandler.CreateNode] creates provisional nodes which are removed after
+	// this duration unless they are confirmed.
+	ProvisionalTTL time.Duration
+
+	// If non zero, [EtcdHandler.CreateNode] selects this number of concentrators from the
+	// concentrator registry for new nodes, see [AssignConcentrators].
+	AssignedConcentrators int
+}
+
+// The maximum number of operations in one transaction, etcd allows 128 by default
+const txnChunkSize = 100
+
+// Returns the etcd request reading the node with the given pubkey for [fillNodeInfo].
+func nodeInfoOp(pubkey string) clientv3.Op {
+	return clientv3.OpGet(CONFIG_PREFIX+pubkey+"/", clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
 }
 
-func (eh EtcdHandler) fillNodeInfo(ctx context.Context, pubkey string, info *NodeInfo) error {
+// Unmarshals the response of [nodeInfoOp] into info.
+func fillNodeInfo(resp *clientv3.GetResponse, pubkey string, info *NodeInfo) error {
 	prefix := CONFIG_PREFIX + pubkey + "/"
-	applied, err := etcdhelper.UnmarshalGet(ctx, eh.KV, prefix, info)
+	applied, err := etcdhelper.UnmarshalResponse(resp, prefix, info)
 
 	if err == nil && applied == 0 {
 		return &NodeNotFoundError{
@@ -34,7 +59,12 @@ func (eh EtcdHandler) fillNodeInfo(ctx context.Context, pubkey string, info *Nod
 // Use this function only if you don't want the default values. Otherwise consider using [EtcdHandler.GetNodeInfo]
 func (eh EtcdHandler) GetOnlyNodeInfo(ctx context.Context, pubkey string) (*NodeInfo, error) {
 	info := &NodeInfo{}
-	err := eh.fillNodeInfo(ctx, pubkey, info)
+	resp, err := eh.KV.Do(ctx, nodeInfoOp(pubkey))
+	if err != nil {
+		return info, err
+	}
+	info.Revision = resp.Get().Header.Revision
+	err = fillNodeInfo(resp.Get(), pubkey, info)
 	return info, err
 }
 
@@ -46,59 +76,180 @@ func (eh EtcdHandler) GetDefaultNodeInfo(ctx context.Context) (*NodeInfo, error)
 // Get the node info fo a given Wireguard pubkey.
 //
 // This function will use the [EtcdHandler.GetDefaultNodeInfo] values as a basis and override them with
-// the specific node information from [EtcdHandler.GetOnlyNodeInfo]
+// the specific node information from [EtcdHandler.GetOnlyNodeInfo]. The access control lists, the default
+// values and the node values are read in a single transaction, so they always belong to the same etcd revision,
+// which is returned in [NodeInfo.Revision].
+//
+// If the node is blocked by the access control lists, a [NodeBlockedError] is returned.
 func (eh EtcdHandler) GetNodeInfo(ctx context.Context, pubkey string) (*NodeInfo, error) {
-	info, err := eh.GetDefaultNodeInfo(ctx)
+	ops := append(nodeACLOps(pubkey), nodeInfoOp(DEFAULT_NODE_KEY), nodeInfoOp(pubkey))
+	txresp, err := eh.KV.Txn(ctx).Then(ops...).Commit()
 	if err != nil {
 		return nil, err
 	}
-	if err := eh.fillNodeInfo(ctx, pubkey, info); err != nil {
+	if err := checkNodeACLResponses(pubkey, txresp.Responses); err != nil {
+		return nil, err
+	}
+
+	info := &NodeInfo{
+		Revision: txresp.Header.Revision,
+	}
+	n := len(txresp.Responses)
+	if err := fillNodeInfo((*clientv3.GetResponse)(txresp.Responses[n-2].GetResponseRange()), DEFAULT_NODE_KEY, info); err != nil {
+		return nil, err
+	}
+	if err := fillNodeInfo((*clientv3.GetResponse)(txresp.Responses[n-1].GetResponseRange()), pubkey, info); err != nil {
 		return nil, err
 	}
 	return info, nil
 }
 
+// Get the administrative metadata of a node stored at the /config/[pubkey]/meta/ etcd prefix.
+//
+// Nodes without any metadata return an empty [NodeMeta].
+func (eh EtcdHandler) GetNodeMeta(ctx context.Context, pubkey string) (*NodeMeta, error) {
+	meta := &NodeMeta{}
+	prefix := CONFIG_PREFIX + pubkey + "/" + META_PREFIX
+	if _, err := etcdhelper.UnmarshalGet(ctx, eh.KV, prefix, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Stores the administrative metadata of an existing node.
+//
+// Only the non-nil values of meta are written, all other values stay untouched.
+// If the node doesn't exist, a [NodeNotFoundError] is returned.
+func (eh EtcdHandler) SetNodeMeta(ctx context.Context, pubkey string, meta *NodeMeta) error {
+	return eh.modifyNode(ctx, pubkey, AUDIT_UPDATE, func(resp *clientv3.GetResponse, values map[string]string) error {
+		for key, value := range opValues(etcdhelper.Marshal(meta, ""), "") {
+			values[META_PREFIX+key] = value
+		}
+		return nil
+	})
+}
+
 // Indicates that the [NEXT_FREE_ID_KEY] is not present in the etcd instance
 var ErrMissingNextFreeID = errors.New("Couldn't find the key for next free id")
 
 // Adds a new node to the etcd KV store.
 //
 // This function will retrieve a free node id and initialize a [NodeInfo] struct using it.
+// IDs released by expired provisional nodes are reused before a new id is taken from [NEXT_FREE_ID_KEY].
 // Afterwards it calls the updateNodeInfo function to fill the struct and inserts the results into etcd.
+// If updateNodeInfo returns an error, the node isn't created and the error is returned.
+// Additionally the creation time is stored in the [NodeMeta] of the node.
 // The function may be called multiple times if the node id was already claimed when inserting the node into etcd.
-func (eh EtcdHandler) CreateNode(ctx context.Context, pubkey string, updateNodeInfo func(*NodeInfo)) error {
+//
+// If [EtcdHandler.ProvisionalTTL] is set, the node is created as provisional node, see [EtcdHandler.ConfirmNode].
+// If [EtcdHandler.AssignedConcentrators] is set, the selected concentrators are filled before calling updateNodeInfo.
+// Routed prefixes set by updateNodeInfo are checked like in [EtcdHandler.SetRoutedPrefixes].
+// If the node is blocked by the access control lists, a [NodeBlockedError] is returned.
+func (eh EtcdHandler) CreateNode(ctx context.Context, pubkey string, updateNodeInfo func(*NodeInfo) error) error {
+	return eh.createNode(ctx, pubkey, updateNodeInfo, eh.ProvisionalTTL, nil, nil)
+}
+
+// Implements [EtcdHandler.CreateNode].
+//
+// The node is only inserted if all cmps succeed. The extraOps are executed in the same transaction.
+func (eh EtcdHandler) createNode(ctx context.Context, pubkey string, updateNodeInfo func(*NodeInfo) error, provisionalTTL time.Duration, cmps []clientv3.Cmp, extraOps []clientv3.Op) (err error) {
+	if err := eh.checkNodeACL(ctx, pubkey); err != nil {
+		return err
+	}
 	prefix := CONFIG_PREFIX + pubkey + "/"
+
+	var leaseOpts []clientv3.OpOption
+	var leaseID clientv3.LeaseID
+	if provisionalTTL > 0 {
+		if eh.Lease == nil {
+			return ErrMissingLease
+		}
+		lease, err := eh.Lease.Grant(ctx, int64(provisionalTTL/time.Second))
+		if err != nil {
+			return err
+		}
+		leaseID = lease.ID
+		leaseOpts = append(leaseOpts, clientv3.WithLease(leaseID))
+		defer func() {
+			if err != nil {
+				// the lease isn't attached to any key, so nothing would ever revoke it
+				eh.Lease.Revoke(context.WithoutCancel(ctx), leaseID)
+			}
+		}()
+	}
+
+	var selected *string
+	if eh.AssignedConcentrators > 0 {
+		concentrators, err := eh.GetConcentrators(ctx)
+		if err != nil {
+			return err
+		}
+		if set := AssignConcentrators(pubkey, concentrators, eh.AssignedConcentrators); len(set) > 0 {
+			list := set.String()
+			selected = &list
+		}
+	}
+
 	for {
-		resp, err := eh.KV.Get(ctx, NEXT_FREE_ID_KEY)
+		alloc, err := eh.allocateID(ctx)
 		if err != nil {
 			return err
 		}
-		if len(resp.Kvs) == 0 {
-			return ErrMissingNextFreeID
+
+		id := alloc.id
+		nodeinfo := NodeInfo{
+			ID:                    &id,
+			SelectedConcentrators: selected,
+		}
+		if err := updateNodeInfo(&nodeinfo); err != nil {
+			return err
 		}
-		id, err := strconv.ParseUint(string(resp.Kvs[0].Value), 10, 64)
+		prefixCmps, err := eh.checkNewRoutedPrefixes(ctx, pubkey, &nodeinfo)
 		if err != nil {
 			return err
 		}
 
-		checkID := clientv3.Compare(clientv3.Value(NEXT_FREE_ID_KEY), "=", strconv.FormatUint(id, 10))
-		updateID := clientv3.OpPut(NEXT_FREE_ID_KEY, strconv.FormatUint(id+1, 10))
+		createdAt := time.Now().Unix()
+		meta := NodeMeta{
+			CreatedAt: &createdAt,
+		}
+
+		ops := etcdhelper.Marshal(&nodeinfo, prefix, leaseOpts...)
+		ops = append(ops, etcdhelper.Marshal(&meta, prefix+META_PREFIX, leaseOpts...)...)
+		ops = append(ops, alloc.ops...)
+		ops = append(ops, clientv3.OpPut(idIndexKey(id), pubkey, leaseOpts...))
 
-		nodeinfo := NodeInfo{
-			ID: &id,
+		provisionalKey := PROVISIONAL_PREFIX + strconv.FormatUint(id, 10)
+		if leaseID != 0 {
+			ops = append(ops,
+				clientv3.OpPut(prefix+PROVISIONAL_LEASE_KEY, strconv.FormatInt(int64(leaseID), 10), leaseOpts...),
+				clientv3.OpPut(provisionalKey, pubkey),
+			)
+		} else if alloc.reused {
+			ops = append(ops, clientv3.OpDelete(provisionalKey))
 		}
-		updateNodeInfo(&nodeinfo)
 
-		ops := etcdhelper.Marshal(&nodeinfo, prefix)
+		ops = append(ops, extraOps...)
+		ops = append(ops, eh.auditOp(pubkey, AUDIT_CREATE, nil, opValues(ops, prefix)))
 
-		ops = append(ops, updateID)
-		txresp, err := eh.KV.Txn(ctx).If(checkID).Then(ops...).Commit()
+		conditions := append(append(alloc.cmps, cmps...), prefixCmps...)
+		txresp, err := eh.KV.Txn(ctx).If(conditions...).Then(ops...).Commit()
 		if err != nil {
 			return err
 		}
 		if txresp.Succeeded {
 			return nil
 		}
+		if len(cmps) > 0 {
+			// check whether the failed transaction was caused by the additional conditions
+			txresp, err := eh.KV.Txn(ctx).If(cmps...).Commit()
+			if err != nil {
+				return err
+			}
+			if !txresp.Succeeded {
+				return ErrConditionFailed
+			}
+		}
 	}
 }
 
@@ -0,0 +1,289 @@
+package ffbs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Indicates that an operation isn't supported by the [FileNodeStore]
+var ErrUnsupportedByFileStore = errors.New("The operation isn't supported by the file node store")
+
+// Indicates that a pubkey can't be used as file name
+var ErrInvalidPubkey = errors.New("The pubkey contains invalid characters")
+
+var FILE_PUBKEY = regexp.MustCompile(`^[A-Za-z0-9=_-]+$`)
+
+// A [NodeStore] keeping the nodes as JSON files in a directory, e.g. for small setups and tests without etcd.
+//
+// The directory contains the following files using the JSON representation of the values:
+//   - default.json with the default [NodeInfo] including the concentrators
+//   - acl.json with the optional [ACL]
+//   - address_plan.json with the optional [AddressAllocator], see [EtcdHandler.GetAddressPlan]
+//   - nodes/[pubkey].json with the [NodeInfo] of every node, which may also contain the selected_concentrators
+//
+// Node ids are allocated by taking the highest used id plus one, so only a single process may create nodes
+// at a time. Registration modes, pending and provisional nodes and schema versions aren't supported,
+// the corresponding methods return [ErrUnsupportedByFileStore]. Callers should accept every node in this case.
+type FileNodeStore struct {
+	Dir string
+
+	lock sync.Mutex // serializes the node creations
+}
+
+func (s *FileNodeStore) nodePath(pubkey string) (string, error) {
+	if !FILE_PUBKEY.MatchString(pubkey) {
+		return "", ErrInvalidPubkey
+	}
+	return filepath.Join(s.Dir, "nodes", pubkey+".json"), nil
+}
+
+// Reads a JSON file into dest. The values already set in dest are only overwritten if they are in the file.
+func readJSONFile(path string, dest any) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewDecoder(f).Decode(dest)
+}
+
+// The JSON representation of a node file.
+//
+// The selected concentrators are only read from the files, they aren't part of the JSON representation of
+// the [NodeInfo], as it is sent to the nodes.
+type nodeFile struct {
+	*NodeInfo
+	SelectedConcentrators *string `json:"selected_concentrators,omitempty"`
+}
+
+// Reads a node file into info like [readJSONFile].
+func readNodeFile(path string, info *NodeInfo) error {
+	file := nodeFile{NodeInfo: info}
+	if err := readJSONFile(path, &file); err != nil {
+		return err
+	}
+	if file.SelectedConcentrators != nil {
+		info.SelectedConcentrators = file.SelectedConcentrators
+	}
+	return nil
+}
+
+// Reads the node file of the pubkey into info.
+func (s *FileNodeStore) fillNodeInfo(pubkey string, info *NodeInfo) error {
+	path := filepath.Join(s.Dir, "default.json")
+	if pubkey != DEFAULT_NODE_KEY {
+		var err error
+		if path, err = s.nodePath(pubkey); err != nil {
+			return err
+		}
+	}
+
+	err := readNodeFile(path, info)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &NodeNotFoundError{
+			Pubkey: pubkey,
+		}
+	}
+	return err
+}
+
+// Get the default node info stored in default.json.
+func (s *FileNodeStore) GetDefaultNodeInfo(ctx context.Context) (*NodeInfo, error) {
+	info := &NodeInfo{}
+	if err := s.fillNodeInfo(DEFAULT_NODE_KEY, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Get the node info for a given Wireguard pubkey with the default values applied.
+//
+// If the node is blocked by the access control lists, a [NodeBlockedError] is returned.
+func (s *FileNodeStore) GetNodeInfo(ctx context.Context, pubkey string) (*NodeInfo, error) {
+	acl, err := s.GetACL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := acl.Check(pubkey); err != nil {
+		return nil, err
+	}
+
+	info, err := s.GetDefaultNodeInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.fillNodeInfo(pubkey, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Retrieves all nodes without the default values applied and the default node.
+func (s *FileNodeStore) GetAllNodeInfo(ctx context.Context) (map[string]*NodeInfo, *NodeInfo, error) {
+	defaultNode, err := s.GetDefaultNodeInfo(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "nodes", "*.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes := make(map[string]*NodeInfo, len(paths))
+	for _, path := range paths {
+		info := &NodeInfo{}
+		if err := readNodeFile(path, info); err != nil {
+			return nil, nil, err
+		}
+		nodes[strings.TrimSuffix(filepath.Base(path), ".json")] = info
+	}
+	return nodes, defaultNode, nil
+}
+
+// Returns the number of node files.
+func (s *FileNodeStore) NodeCount(ctx context.Context) (uint64, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "nodes", "*.json"))
+	return uint64(len(paths)), err
+}
+
+// Adds a new node file with the highest used id plus one, see [EtcdHandler.CreateNode].
+//
+// If the node already exists, [ErrNodeExists] is returned.
+func (s *FileNodeStore) CreateNode(ctx context.Context, pubkey string, updateNodeInfo func(*NodeInfo) error) error {
+	acl, err := s.GetACL(ctx)
+	if err != nil {
+		return err
+	}
+	if err := acl.Check(pubkey); err != nil {
+		return err
+	}
+	path, err := s.nodePath(pubkey)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	nodes, _, err := s.GetAllNodeInfo(ctx)
+	if err != nil {
+		return err
+	}
+	var id uint64 = 1
+	for _, node := range nodes {
+		if node.ID != nil && *node.ID >= id {
+			id = *node.ID + 1
+		}
+	}
+
+	info := NodeInfo{
+		ID: &id,
+	}
+	if err := updateNodeInfo(&info); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(nodeFile{&info, info.SelectedConcentrators}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// write a temporary file and link it to only create complete node files
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".create-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return ErrNodeExists
+		}
+		return err
+	}
+	return nil
+}
+
+// Returns [ErrUnsupportedByFileStore], as the file store doesn't create provisional nodes.
+func (s *FileNodeStore) ConfirmNode(ctx context.Context, pubkey string) error {
+	return ErrUnsupportedByFileStore
+}
+
+// Returns the concentrators of default.json sorted by their id like [EtcdHandler.GetConcentrators].
+func (s *FileNodeStore) GetConcentrators(ctx context.Context) ([]ConcentratorInfo, error) {
+	info, err := s.GetDefaultNodeInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	concentrators := make([]ConcentratorInfo, 0, len(info.Concentrators))
+	for _, concentrator := range info.Concentrators {
+		if concentrator.State == "" {
+			concentrator.State = CONCENTRATOR_ACTIVE
+		}
+		concentrators = append(concentrators, concentrator)
+	}
+	sort.Slice(concentrators, func(i, j int) bool {
+		return concentrators[i].ID < concentrators[j].ID
+	})
+	return concentrators, nil
+}
+
+// Returns the concentrators of the node info like [EtcdHandler.GetNodeConcentrators].
+//
+// The concentrators are taken from the node info, which are usually the ones of default.json.
+func (s *FileNodeStore) GetNodeConcentrators(ctx context.Context, info *NodeInfo) ([]ConcentratorInfo, error) {
+	return nodeConcentrators(info, info.Concentrators)
+}
+
+// Retrieves the access control lists stored in acl.json. A missing file results in empty lists.
+func (s *FileNodeStore) GetACL(ctx context.Context) (*ACL, error) {
+	acl := &ACL{}
+	err := readJSONFile(filepath.Join(s.Dir, "acl.json"), acl)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Returns [ErrUnsupportedByFileStore], as the file store has no registration modes.
+func (s *FileNodeStore) GetRegistrationMode(ctx context.Context) (RegistrationMode, error) {
+	return "", ErrUnsupportedByFileStore
+}
+
+// Returns [ErrUnsupportedByFileStore], as the file store has no pending nodes.
+func (s *FileNodeStore) AddPendingNode(ctx context.Context, pubkey string, request PendingNode) error {
+	return ErrUnsupportedByFileStore
+}
+
+// Returns [ErrUnsupportedByFileStore], as the file layout isn't versioned.
+func (s *FileNodeStore) CheckSchemaVersion(ctx context.Context) error {
+	return ErrUnsupportedByFileStore
+}
+
+// Returns the address plan stored in address_plan.json like [EtcdHandler.GetAddressPlan].
+func (s *FileNodeStore) GetAddressPlan(ctx context.Context) (AddressAllocator, error) {
+	value, err := os.ReadFile(filepath.Join(s.Dir, "address_plan.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return DefaultAddressAllocator, nil
+	}
+	if err != nil {
+		return AddressAllocator{}, err
+	}
+	return parseAddressPlan(value)
+}
@@ -0,0 +1,446 @@
+package ffbs
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// The kind of inconsistency reported by [EtcdHandler.Fsck]
+type FsckKind string
+
+const (
+	FSCK_MISSING_ID        FsckKind = "missing_id"        // node without id key
+	FSCK_DUPLICATE_ID      FsckKind = "duplicate_id"      // id used by multiple nodes
+	FSCK_OVERLAPPING_RANGE FsckKind = "overlapping_range" // range or routed prefix overlapping another range or routed prefix
+	FSCK_NEXT_FREE_ID      FsckKind = "next_free_id"      // missing or invalid next free id or not above the highest used id
+	FSCK_RANGE_MISMATCH    FsckKind = "range_mismatch"    // range not matching the address allocator for the id
+	FSCK_INVALID_PUBKEY    FsckKind = "invalid_pubkey"    // pubkey not being 32 bytes encoded as base64url
+	FSCK_UNPARSABLE_VALUE  FsckKind = "unparsable_value"  // value not matching the type of the key
+	FSCK_ID_INDEX          FsckKind = "id_index"          // missing or stale entry of the id index
+)
+
+// An inconsistency found by [EtcdHandler.Fsck]
+type FsckFinding struct {
+	Kind     FsckKind `json:"kind"`
+	Pubkey   string   `json:"pubkey,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	Message  string   `json:"message"`
+	Repaired bool     `json:"repaired,omitempty"`
+	Change   string   `json:"change,omitempty"` // values written by the repair
+}
+
+// Checks whether the pubkey is a 32 bytes Wireguard key encoded as base64url.
+func validPubkey(pubkey string) bool {
+	key, err := base64.URLEncoding.DecodeString(pubkey)
+	return err == nil && len(key) == 32
+}
+
+// Checks whether a single node value can be unmarshaled.
+func checkNodeValue(prefix string, kv *mvccpb.KeyValue) error {
+	resp := &clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{kv}}
+	if strings.HasPrefix(string(kv.Key), prefix+META_PREFIX) {
+		_, err := etcdhelper.UnmarshalResponse(resp, prefix+META_PREFIX, &NodeMeta{})
+		return err
+	}
+	_, err := etcdhelper.UnmarshalResponse(resp, prefix, &NodeInfo{})
+	return err
+}
+
+// Checks the node database for inconsistencies.
+//
+// The node ranges are compared against the stored address plan, see [EtcdHandler.GetAddressPlan].
+// If repair is set, the findings which can be fixed without ambiguity are repaired and marked
+// accordingly: a too low [NEXT_FREE_ID_KEY] is raised above the highest used id (at least 1)
+// and the id index is rebuilt. If renumber is set, the mismatching ranges and addresses of nodes
+// with a unique id are reallocated, which changes the addresses the nodes use. All other findings
+// have to be resolved manually.
+func (eh EtcdHandler) Fsck(ctx context.Context, repair bool, renumber bool) ([]FsckFinding, error) {
+	txresp, err := eh.KV.Txn(ctx).Then(
+		clientv3.OpGet(CONFIG_PREFIX, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)),
+		clientv3.OpGet(NEXT_FREE_ID_KEY),
+		clientv3.OpGet(ID_INDEX_PREFIX, clientv3.WithPrefix()),
+		clientv3.OpGet(ADDRESS_PLAN_KEY),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+	configResp := txresp.Responses[0].GetResponseRange()
+	nextFreeResp := txresp.Responses[1].GetResponseRange()
+	indexResp := txresp.Responses[2].GetResponseRange()
+	allocator, err := addressPlanFromResponse((*clientv3.GetResponse)(txresp.Responses[3].GetResponseRange()))
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []FsckFinding
+
+	// group the keys by node
+	var pubkeys []string
+	nodes := make(map[string][]*mvccpb.KeyValue)
+	for _, kv := range configResp.Kvs {
+		pubkey, _, ok := strings.Cut(strings.TrimPrefix(string(kv.Key), CONFIG_PREFIX), "/")
+		if !ok || pubkey == DEFAULT_NODE_KEY {
+			continue
+		}
+		if _, ok := nodes[pubkey]; !ok {
+			pubkeys = append(pubkeys, pubkey)
+		}
+		nodes[pubkey] = append(nodes[pubkey], kv)
+	}
+
+	type nodeRange struct {
+		pubkey string
+		prefix netip.Prefix
+	}
+	var ranges []nodeRange
+	idUsers := make(map[uint64][]string)
+	ids := make(map[string]uint64)
+	nodeValues := make(map[string]map[string]string)
+	var highestID uint64
+	hasID := false
+
+	for _, pubkey := range pubkeys {
+		prefix := CONFIG_PREFIX + pubkey + "/"
+		if !validPubkey(pubkey) {
+			findings = append(findings, FsckFinding{
+				Kind:    FSCK_INVALID_PUBKEY,
+				Pubkey:  pubkey,
+				Message: "pubkey isn't a 32 bytes base64url encoded key",
+			})
+		}
+
+		values := make(map[string]string)
+		nodeValues[pubkey] = values
+		for _, kv := range nodes[pubkey] {
+			key := strings.TrimPrefix(string(kv.Key), prefix)
+			values[key] = string(kv.Value)
+			if err := checkNodeValue(prefix, kv); err != nil {
+				findings = append(findings, FsckFinding{
+					Kind:    FSCK_UNPARSABLE_VALUE,
+					Pubkey:  pubkey,
+					Key:     key,
+					Message: err.Error(),
+				})
+			}
+		}
+
+		for _, key := range []string{"range4", "range6"} {
+			value, ok := values[key]
+			if !ok {
+				continue
+			}
+			if p, err := netip.ParsePrefix(value); err == nil {
+				ranges = append(ranges, nodeRange{pubkey, p.Masked()})
+			}
+		}
+		if value, ok := values["routed_prefixes"]; ok {
+			routed, err := ParsePrefixList(value)
+			if err != nil {
+				findings = append(findings, FsckFinding{
+					Kind:    FSCK_UNPARSABLE_VALUE,
+					Pubkey:  pubkey,
+					Key:     "routed_prefixes",
+					Message: err.Error(),
+				})
+			}
+			for _, p := range routed {
+				ranges = append(ranges, nodeRange{pubkey, p})
+			}
+		}
+
+		value, ok := values["id"]
+		if !ok {
+			findings = append(findings, FsckFinding{
+				Kind:    FSCK_MISSING_ID,
+				Pubkey:  pubkey,
+				Key:     "id",
+				Message: "node has no id",
+			})
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			// already reported as unparsable value
+			continue
+		}
+		ids[pubkey] = id
+		idUsers[id] = append(idUsers[id], pubkey)
+		if !hasID || id > highestID {
+			highestID = id
+			hasID = true
+		}
+	}
+
+	// duplicate ids
+	var duplicates []uint64
+	for id, users := range idUsers {
+		if len(users) > 1 {
+			duplicates = append(duplicates, id)
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i] < duplicates[j] })
+	for _, id := range duplicates {
+		for _, pubkey := range idUsers[id] {
+			findings = append(findings, FsckFinding{
+				Kind:    FSCK_DUPLICATE_ID,
+				Pubkey:  pubkey,
+				Key:     "id",
+				Message: fmt.Sprintf("id %d is used by the nodes %s", id, strings.Join(idUsers[id], ", ")),
+			})
+		}
+	}
+
+	// overlapping ranges: as prefixes are either nested or disjoint, after sorting any range
+	// overlapping a previous range is contained in the last range without any overlap
+	sort.Slice(ranges, func(i, j int) bool {
+		if c := ranges[i].prefix.Addr().Compare(ranges[j].prefix.Addr()); c != 0 {
+			return c < 0
+		}
+		return ranges[i].prefix.Bits() < ranges[j].prefix.Bits()
+	})
+	var cover *nodeRange
+	for i := range ranges {
+		r := &ranges[i]
+		if cover != nil && cover.prefix.Addr().BitLen() == r.prefix.Addr().BitLen() && cover.prefix.Overlaps(r.prefix) {
+			findings = append(findings, FsckFinding{
+				Kind:    FSCK_OVERLAPPING_RANGE,
+				Pubkey:  r.pubkey,
+				Message: fmt.Sprintf("range %s overlaps the range %s of the node %s", r.prefix, cover.prefix, cover.pubkey),
+			})
+			continue
+		}
+		cover = r
+	}
+
+	// ranges matching the allocator
+	for _, pubkey := range pubkeys {
+		id, ok := ids[pubkey]
+		if !ok {
+			continue
+		}
+		range4, err := allocator.Range4(id)
+		var range6 netip.Prefix
+		if err == nil {
+			range6, err = allocator.Range6(id)
+		}
+		if err != nil {
+			findings = append(findings, FsckFinding{
+				Kind:    FSCK_RANGE_MISMATCH,
+				Pubkey:  pubkey,
+				Key:     "id",
+				Message: err.Error(),
+			})
+			continue
+		}
+		expected := map[string]netip.Prefix{
+			"range4": range4,
+			"range6": range6,
+		}
+		for _, key := range []string{"range4", "range6"} {
+			value, found := nodeValues[pubkey][key]
+			var message string
+			if !expected[key].IsValid() {
+				// the family isn't used
+				if !found {
+					continue
+				}
+				message = fmt.Sprintf("%s is %s, but the family isn't used", key, value)
+			} else if p, err := netip.ParsePrefix(value); found && err == nil && p.Masked() == expected[key] {
+				continue
+			} else if found {
+				message = fmt.Sprintf("%s is %s, expected %s", key, value, expected[key])
+			} else {
+				message = fmt.Sprintf("%s is missing, expected %s", key, expected[key])
+			}
+			findings = append(findings, FsckFinding{
+				Kind:    FSCK_RANGE_MISMATCH,
+				Pubkey:  pubkey,
+				Key:     key,
+				Message: message,
+			})
+		}
+	}
+
+	// id index
+	indexed := make(map[uint64]*mvccpb.KeyValue)
+	for _, kv := range indexResp.Kvs {
+		id, err := strconv.ParseUint(strings.TrimPrefix(string(kv.Key), ID_INDEX_PREFIX), 10, 64)
+		if err != nil {
+			findings = append(findings, FsckFinding{
+				Kind:    FSCK_ID_INDEX,
+				Key:     string(kv.Key),
+				Message: "index key without a valid id",
+			})
+			continue
+		}
+		indexed[id] = kv
+	}
+	var indexIDs []uint64
+	for id := range idUsers {
+		indexIDs = append(indexIDs, id)
+	}
+	for id := range indexed {
+		if _, ok := idUsers[id]; !ok {
+			indexIDs = append(indexIDs, id)
+		}
+	}
+	sort.Slice(indexIDs, func(i, j int) bool { return indexIDs[i] < indexIDs[j] })
+	for _, id := range indexIDs {
+		users := idUsers[id]
+		kv := indexed[id]
+		finding := FsckFinding{
+			Kind: FSCK_ID_INDEX,
+			Key:  idIndexKey(id),
+		}
+		var repairOp clientv3.Op
+		var change string
+		unchanged := clientv3.Compare(clientv3.ModRevision(idIndexKey(id)), "=", 0)
+		if kv != nil {
+			unchanged = clientv3.Compare(clientv3.ModRevision(idIndexKey(id)), "=", kv.ModRevision)
+		}
+		switch {
+		case len(users) == 0:
+			finding.Pubkey = string(kv.Value)
+			finding.Message = "index entry of an unused id"
+			repairOp = clientv3.OpDelete(idIndexKey(id))
+			change = "delete " + idIndexKey(id)
+		case len(users) > 1:
+			// already reported as duplicate id
+			continue
+		case kv == nil:
+			finding.Pubkey = users[0]
+			finding.Message = "id is missing in the index"
+			repairOp = clientv3.OpPut(idIndexKey(id), users[0])
+			change = idIndexKey(id) + " = " + users[0]
+		case string(kv.Value) != users[0]:
+			finding.Pubkey = users[0]
+			finding.Message = fmt.Sprintf("index entry points to %s", kv.Value)
+			repairOp = clientv3.OpPut(idIndexKey(id), users[0])
+			change = idIndexKey(id) + " = " + users[0]
+		default:
+			continue
+		}
+		if repair {
+			resp, err := eh.KV.Txn(ctx).If(unchanged).Then(repairOp).Commit()
+			if err != nil {
+				return findings, err
+			}
+			finding.Repaired = resp.Succeeded
+			if resp.Succeeded {
+				finding.Change = change
+			}
+		}
+		findings = append(findings, finding)
+	}
+
+	// next free id
+	var nextFreeID uint64
+	nextFreeValid := false
+	nextFree := FsckFinding{
+		Kind: FSCK_NEXT_FREE_ID,
+		Key:  NEXT_FREE_ID_KEY,
+	}
+	if len(nextFreeResp.Kvs) == 0 {
+		nextFree.Message = "next free id is missing"
+	} else if nextFreeID, err = strconv.ParseUint(string(nextFreeResp.Kvs[0].Value), 10, 64); err != nil {
+		nextFree.Message = err.Error()
+	} else if nextFreeID == 0 {
+		nextFree.Message = "next free id must be at least 1"
+	} else if hasID && nextFreeID <= highestID {
+		nextFree.Message = fmt.Sprintf("next free id %d isn't above the highest used id %d", nextFreeID, highestID)
+	} else {
+		nextFreeValid = true
+	}
+	if !nextFreeValid {
+		if repair {
+			newID := uint64(1)
+			if hasID {
+				newID = max(highestID+1, newID)
+			}
+			if len(nextFreeResp.Kvs) == 0 || newID > nextFreeID {
+				unchanged := clientv3.Compare(clientv3.ModRevision(NEXT_FREE_ID_KEY), "=", 0)
+				if len(nextFreeResp.Kvs) > 0 {
+					unchanged = clientv3.Compare(clientv3.ModRevision(NEXT_FREE_ID_KEY), "=", nextFreeResp.Kvs[0].ModRevision)
+				}
+				resp, err := eh.KV.Txn(ctx).If(unchanged).Then(clientv3.OpPut(NEXT_FREE_ID_KEY, strconv.FormatUint(newID, 10))).Commit()
+				if err != nil {
+					return findings, err
+				}
+				nextFree.Repaired = resp.Succeeded
+				if resp.Succeeded {
+					nextFree.Change = fmt.Sprintf("%s = %d", NEXT_FREE_ID_KEY, newID)
+				}
+			}
+		}
+		findings = append(findings, nextFree)
+	}
+
+	if renumber {
+		changes := make(map[string]*string)
+		for i := range findings {
+			finding := &findings[i]
+			id := ids[finding.Pubkey]
+			if finding.Kind != FSCK_RANGE_MISMATCH || len(idUsers[id]) != 1 {
+				continue
+			}
+			if _, ok := changes[finding.Pubkey]; !ok {
+				changes[finding.Pubkey] = nil
+				err := eh.UpdateNode(ctx, finding.Pubkey, func(info *NodeInfo) {
+					// the id may have been changed concurrently
+					if info.ID == nil || *info.ID != id {
+						return
+					}
+					before := *info
+					if allocator.FillNodeInfo(info) == nil {
+						change := describeAddressChanges(before, *info)
+						changes[finding.Pubkey] = &change
+					}
+				})
+				if err != nil {
+					return findings, err
+				}
+			}
+			if change := changes[finding.Pubkey]; change != nil {
+				finding.Repaired = true
+				finding.Change = *change
+			}
+		}
+	}
+
+	return findings, nil
+}
+
+// Describes the changed addresses and ranges of a node renumbered by [EtcdHandler.Fsck].
+func describeAddressChanges(before NodeInfo, after NodeInfo) string {
+	value := func(v *string) string {
+		if v == nil {
+			return "(none)"
+		}
+		return *v
+	}
+	var changes []string
+	for _, c := range []struct {
+		key           string
+		before, after *string
+	}{
+		{"address4", before.Address4, after.Address4},
+		{"range4", before.Range4, after.Range4},
+		{"address6", before.Address6, after.Address6},
+		{"range6", before.Range6, after.Range6},
+	} {
+		if value(c.before) != value(c.after) {
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", c.key, value(c.before), value(c.after)))
+		}
+	}
+	return strings.Join(changes, ", ")
+}
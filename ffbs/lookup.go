@@ -0,0 +1,182 @@
+package ffbs
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Returns the key of the id index entry, which stores the pubkey of the node with the id.
+//
+// The index is only a hint: lookups verify the entry and fall back to a full scan, and
+// [EtcdHandler.Fsck] reports and repairs missing or stale entries.
+func idIndexKey(id uint64) string {
+	return ID_INDEX_PREFIX + strconv.FormatUint(id, 10)
+}
+
+// Adds the id index entries of the nodes created before the index existed.
+//
+// Nodes sharing an id are skipped, they are reported by [EtcdHandler.Fsck]. As the number of entries
+// may exceed the operations allowed in one transaction, all but the last chunk of entries are written
+// directly. This is safe, as the index is only a hint and the entries are guarded by the id of the node.
+func migrateIDIndex(ctx context.Context, eh EtcdHandler) ([]clientv3.Cmp, []clientv3.Op, error) {
+	txresp, err := eh.KV.Txn(ctx).Then(
+		clientv3.OpGet(CONFIG_PREFIX, clientv3.WithPrefix()),
+		clientv3.OpGet(ID_INDEX_PREFIX, clientv3.WithPrefix(), clientv3.WithKeysOnly()),
+	).Commit()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	indexed := make(map[string]bool)
+	for _, kv := range txresp.Responses[1].GetResponseRange().Kvs {
+		indexed[string(kv.Key)] = true
+	}
+
+	type entry struct {
+		idKey    string
+		pubkey   string
+		revision int64
+	}
+	var entries []entry
+	users := make(map[string]int)
+	for _, kv := range txresp.Responses[0].GetResponseRange().Kvs {
+		pubkey, key, ok := strings.Cut(strings.TrimPrefix(string(kv.Key), CONFIG_PREFIX), "/")
+		if !ok || key != "id" || pubkey == DEFAULT_NODE_KEY {
+			continue
+		}
+		id, err := strconv.ParseUint(string(kv.Value), 10, 64)
+		if err != nil {
+			continue
+		}
+		users[idIndexKey(id)]++
+		if !indexed[idIndexKey(id)] {
+			entries = append(entries, entry{idIndexKey(id), pubkey, kv.ModRevision})
+		}
+	}
+	entries = slices.DeleteFunc(entries, func(e entry) bool {
+		return users[e.idKey] > 1
+	})
+
+	guardedPuts := func(entries []entry) (cmps []clientv3.Cmp, ops []clientv3.Op) {
+		for _, e := range entries {
+			cmps = append(cmps,
+				clientv3.Compare(clientv3.CreateRevision(e.idKey), "=", 0),
+				clientv3.Compare(clientv3.ModRevision(CONFIG_PREFIX+e.pubkey+"/id"), "=", e.revision),
+			)
+			ops = append(ops, clientv3.OpPut(e.idKey, e.pubkey))
+		}
+		return cmps, ops
+	}
+
+	// every entry needs two compares
+	chunkSize := txnChunkSize / 2
+	for len(entries) > chunkSize {
+		cmps, ops := guardedPuts(entries[:chunkSize])
+		txresp, err := eh.KV.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+		if !txresp.Succeeded {
+			// fails again with the version update, so the migration is retried with the current state
+			return cmps, ops, nil
+		}
+		entries = entries[chunkSize:]
+	}
+	cmps, ops := guardedPuts(entries)
+	return cmps, ops, nil
+}
+
+// Returns the first node in pubkey order matching the filter using a full scan.
+func (eh EtcdHandler) findNode(ctx context.Context, match func(*NodeInfo) bool) (string, *NodeInfo, error) {
+	nodes, _, err := eh.GetAllNodeInfo(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	pubkeys := make([]string, 0, len(nodes))
+	for pubkey := range nodes {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+	for _, pubkey := range pubkeys {
+		if match(nodes[pubkey]) {
+			return pubkey, nodes[pubkey], nil
+		}
+	}
+	return "", nil, nil
+}
+
+// Returns the node with the id referenced by the id index if it matches the filter.
+func (eh EtcdHandler) indexedNode(ctx context.Context, id uint64, match func(*NodeInfo) bool) (string, *NodeInfo, error) {
+	resp, err := eh.KV.Get(ctx, idIndexKey(id))
+	if err != nil || len(resp.Kvs) == 0 {
+		return "", nil, err
+	}
+	pubkey := string(resp.Kvs[0].Value)
+	info, err := eh.GetOnlyNodeInfo(ctx, pubkey)
+	if err != nil || info == nil || !match(info) {
+		// stale index entries are ignored
+		return "", nil, nil
+	}
+	return pubkey, info, nil
+}
+
+// Returns the pubkey and the [NodeInfo] without default values of the node with the given id.
+//
+// The node is looked up using the id index with a full scan as fallback.
+// If no node has the id, a [NodeIDNotFoundError] is returned.
+func (eh EtcdHandler) FindNodeByID(ctx context.Context, id uint64) (string, *NodeInfo, error) {
+	match := func(info *NodeInfo) bool {
+		return info.ID != nil && *info.ID == id
+	}
+	pubkey, info, err := eh.indexedNode(ctx, id, match)
+	if err == nil && info == nil {
+		pubkey, info, err = eh.findNode(ctx, match)
+	}
+	if err == nil && info == nil {
+		err = &NodeIDNotFoundError{ID: id}
+	}
+	return pubkey, info, err
+}
+
+// Returns the pubkey and the [NodeInfo] without default values of the node whose range4, range6
+// or routed prefixes contain the address. This includes the node address itself and the concentrator
+// addresses within the node range, see [ConcentratorAddress].
+//
+// The id of the node is derived from the address using the stored address plan to look the node
+// up in the id index. Nodes with different ranges are found with a full scan.
+// If no node range contains the address, a [NodeAddressNotFoundError] is returned.
+func (eh EtcdHandler) FindNodeByAddress(ctx context.Context, addr netip.Addr) (string, *NodeInfo, error) {
+	addr = addr.Unmap()
+	match := func(info *NodeInfo) bool {
+		for _, p := range info.prefixes(true) {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	plan, err := eh.GetAddressPlan(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var pubkey string
+	var info *NodeInfo
+	if id, ok := plan.ID(addr); ok {
+		pubkey, info, err = eh.indexedNode(ctx, id, match)
+	}
+	if err == nil && info == nil {
+		pubkey, info, err = eh.findNode(ctx, match)
+	}
+	if err == nil && info == nil {
+		err = &NodeAddressNotFoundError{Address: addr}
+	}
+	return pubkey, info, err
+}
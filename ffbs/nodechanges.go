@@ -0,0 +1,269 @@
+package ffbs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Indicates that a node change was aborted on purpose by the modify function of [EtcdHandler.modifyNode]
+var errSkipModification = errors.New("skip modification")
+
+// Indicates that the new pubkey of [EtcdHandler.RotateNodeKey] is already in use
+var ErrNodeExists = errors.New("A node with the pubkey already exists")
+
+// Changes the keys of an existing node with an audit record in the same transaction.
+//
+// The modify function gets the current values of all keys within the /config/[pubkey]/ prefix
+// relative to this prefix and changes them in place. Removed keys are deleted. If the node is
+// changed concurrently, the modification is retried with the new values.
+// If the node doesn't exist, a [NodeNotFoundError] is returned.
+func (eh EtcdHandler) modifyNode(ctx context.Context, pubkey string, action AuditAction, modify func(resp *clientv3.GetResponse, values map[string]string) error) error {
+	prefix := CONFIG_PREFIX + pubkey + "/"
+	for {
+		resp, err := eh.KV.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return &NodeNotFoundError{
+				Pubkey: pubkey,
+			}
+		}
+
+		before := make(map[string]string, len(resp.Kvs))
+		after := make(map[string]string, len(resp.Kvs))
+		var leaseOpts []clientv3.OpOption
+		for _, kv := range resp.Kvs {
+			key := strings.TrimPrefix(string(kv.Key), prefix)
+			before[key] = string(kv.Value)
+			after[key] = string(kv.Value)
+			if key == "id" && kv.Lease != 0 {
+				// keep the keys of provisional nodes attached to their lease
+				leaseOpts = append(leaseOpts, clientv3.WithLease(clientv3.LeaseID(kv.Lease)))
+			}
+		}
+		revision := resp.Header.Revision
+
+		if err := modify(resp, after); err != nil {
+			if errors.Is(err, errSkipModification) {
+				return nil
+			}
+			return err
+		}
+
+		var ops []clientv3.Op
+		for key, value := range after {
+			if oldValue, ok := before[key]; !ok || oldValue != value {
+				ops = append(ops, clientv3.OpPut(prefix+key, value, leaseOpts...))
+			}
+		}
+		for key := range before {
+			if _, ok := after[key]; !ok {
+				ops = append(ops, clientv3.OpDelete(prefix+key))
+			}
+		}
+		if len(ops) == 0 {
+			return nil
+		}
+		ops = append(ops, eh.auditOp(pubkey, action, before, after))
+
+		unchanged := clientv3.Compare(clientv3.ModRevision(prefix), "<", revision+1).WithPrefix()
+		txresp, err := eh.KV.Txn(ctx).If(unchanged).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		if txresp.Succeeded {
+			return nil
+		}
+	}
+}
+
+// Changes the specific [NodeInfo] of an existing node.
+//
+// The update function gets the node info without the default values like [EtcdHandler.GetOnlyNodeInfo].
+// Values set to nil are removed from etcd. If the node doesn't exist, a [NodeNotFoundError] is returned.
+func (eh EtcdHandler) UpdateNode(ctx context.Context, pubkey string, update func(*NodeInfo)) error {
+	prefix := CONFIG_PREFIX + pubkey + "/"
+	return eh.modifyNode(ctx, pubkey, AUDIT_UPDATE, func(resp *clientv3.GetResponse, values map[string]string) error {
+		info := &NodeInfo{}
+		if _, err := etcdhelper.UnmarshalResponse(resp, prefix, info); err != nil {
+			return err
+		}
+
+		for key := range opValues(etcdhelper.Marshal(info, prefix), prefix) {
+			delete(values, key)
+		}
+		update(info)
+		for key, value := range opValues(etcdhelper.Marshal(info, prefix), prefix) {
+			values[key] = value
+		}
+		return nil
+	})
+}
+
+// Removes a node including its metadata and state.
+//
+// The id of the node isn't reused, not even for deleted provisional nodes.
+// If the node doesn't exist, a [NodeNotFoundError] is returned.
+func (eh EtcdHandler) DeleteNode(ctx context.Context, pubkey string) error {
+	prefix := CONFIG_PREFIX + pubkey + "/"
+	for {
+		resp, err := eh.KV.Get(ctx, prefix, clientv3.WithPrefix())
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return &NodeNotFoundError{
+				Pubkey: pubkey,
+			}
+		}
+
+		before := make(map[string]string, len(resp.Kvs))
+		for _, kv := range resp.Kvs {
+			before[strings.TrimPrefix(string(kv.Key), prefix)] = string(kv.Value)
+		}
+
+		ops := []clientv3.Op{
+			clientv3.OpDelete(prefix, clientv3.WithPrefix()),
+			clientv3.OpDelete(STATE_PREFIX+pubkey+"/", clientv3.WithPrefix()),
+			eh.auditOp(pubkey, AUDIT_DELETE, before, nil),
+		}
+		if id, ok := before["id"]; ok {
+			// only remove the index entry if it belongs to this node
+			ops = append(ops, clientv3.OpTxn(
+				[]clientv3.Cmp{clientv3.Compare(clientv3.Value(ID_INDEX_PREFIX+id), "=", pubkey)},
+				[]clientv3.Op{clientv3.OpDelete(ID_INDEX_PREFIX + id)},
+				nil,
+			))
+			// without the tracking key the id of a provisional node isn't released for reuse
+			provisionalKey := PROVISIONAL_PREFIX + id
+			ops = append(ops, clientv3.OpTxn(
+				[]clientv3.Cmp{clientv3.Compare(clientv3.Value(provisionalKey), "=", pubkey)},
+				[]clientv3.Op{clientv3.OpDelete(provisionalKey)},
+				nil,
+			))
+		}
+
+		unchanged := clientv3.Compare(clientv3.ModRevision(prefix), "<", resp.Header.Revision+1).WithPrefix()
+		txresp, err := eh.KV.Txn(ctx).If(unchanged).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		if !txresp.Succeeded {
+			continue
+		}
+
+		if leaseID, err := strconv.ParseInt(before[PROVISIONAL_LEASE_KEY], 10, 64); err == nil && eh.Lease != nil {
+			// the lease doesn't hold any keys anymore. Errors are ignored, as it expires anyway.
+			eh.Lease.Revoke(ctx, clientv3.LeaseID(leaseID))
+		}
+		return nil
+	}
+}
+
+// Moves a node to a new Wireguard pubkey keeping its id, ranges, metadata and state.
+//
+// The audit record is stored for both pubkeys. If the node doesn't exist, a [NodeNotFoundError]
+// is returned. If the new pubkey is already in use, [ErrNodeExists] is returned. If the new pubkey
+// is blocked by the access control lists, a [NodeBlockedError] is returned.
+func (eh EtcdHandler) RotateNodeKey(ctx context.Context, pubkey string, newPubkey string) error {
+	if pubkey == newPubkey {
+		return ErrNodeExists
+	}
+	if err := eh.checkNodeACL(ctx, newPubkey); err != nil {
+		return err
+	}
+	prefix := CONFIG_PREFIX + pubkey + "/"
+	newPrefix := CONFIG_PREFIX + newPubkey + "/"
+	statePrefix := STATE_PREFIX + pubkey + "/"
+	newStatePrefix := STATE_PREFIX + newPubkey + "/"
+	for {
+		txresp, err := eh.KV.Txn(ctx).Then(
+			clientv3.OpGet(prefix, clientv3.WithPrefix()),
+			clientv3.OpGet(statePrefix, clientv3.WithPrefix()),
+			clientv3.OpGet(newStatePrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly()),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		resp := txresp.Responses[0].GetResponseRange()
+		stateResp := txresp.Responses[1].GetResponseRange()
+		newStateResp := txresp.Responses[2].GetResponseRange()
+		if len(resp.Kvs) == 0 {
+			return &NodeNotFoundError{
+				Pubkey: pubkey,
+			}
+		}
+
+		ops := make([]clientv3.Op, 0, len(resp.Kvs)+len(stateResp.Kvs)+len(newStateResp.Kvs)+5)
+		var id string
+		provisional := false
+		for _, kv := range resp.Kvs {
+			key := strings.TrimPrefix(string(kv.Key), prefix)
+			var opts []clientv3.OpOption
+			if kv.Lease != 0 {
+				opts = append(opts, clientv3.WithLease(clientv3.LeaseID(kv.Lease)))
+			}
+			ops = append(ops, clientv3.OpPut(newPrefix+key, string(kv.Value), opts...))
+			switch key {
+			case "id":
+				id = string(kv.Value)
+				ops = append(ops, clientv3.OpPut(ID_INDEX_PREFIX+id, newPubkey, opts...))
+			case PROVISIONAL_LEASE_KEY:
+				provisional = true
+			}
+		}
+		if provisional {
+			ops = append(ops, clientv3.OpPut(PROVISIONAL_PREFIX+id, newPubkey))
+		}
+
+		// move the state and remove leftovers of the new pubkey, which would be mixed into it otherwise
+		moved := make(map[string]bool, len(stateResp.Kvs))
+		for _, kv := range stateResp.Kvs {
+			key := strings.TrimPrefix(string(kv.Key), statePrefix)
+			moved[key] = true
+			ops = append(ops, clientv3.OpPut(newStatePrefix+key, string(kv.Value)))
+		}
+		for _, kv := range newStateResp.Kvs {
+			if !moved[strings.TrimPrefix(string(kv.Key), newStatePrefix)] {
+				ops = append(ops, clientv3.OpDelete(string(kv.Key)))
+			}
+		}
+
+		rotation := map[string]string{"pubkey": pubkey}
+		rotated := map[string]string{"pubkey": newPubkey}
+		ops = append(ops,
+			clientv3.OpDelete(prefix, clientv3.WithPrefix()),
+			clientv3.OpDelete(statePrefix, clientv3.WithPrefix()),
+			eh.auditOp(pubkey, AUDIT_ROTATE, rotation, rotated),
+			eh.auditOp(newPubkey, AUDIT_ROTATE, rotation, rotated),
+		)
+
+		revision := txresp.Header.Revision
+		unchanged := clientv3.Compare(clientv3.ModRevision(prefix), "<", revision+1).WithPrefix()
+		stateUnchanged := clientv3.Compare(clientv3.ModRevision(statePrefix), "<", revision+1).WithPrefix()
+		newStateUnchanged := clientv3.Compare(clientv3.ModRevision(newStatePrefix), "<", revision+1).WithPrefix()
+		newUnused := clientv3.Compare(clientv3.CreateRevision(newPrefix), "=", 0).WithPrefix()
+		rotresp, err := eh.KV.Txn(ctx).If(unchanged, stateUnchanged, newStateUnchanged, newUnused).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		if rotresp.Succeeded {
+			return nil
+		}
+
+		countResp, err := eh.KV.Get(ctx, newPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return err
+		}
+		if countResp.Count > 0 {
+			return ErrNodeExists
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package ffbs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Defines how unknown nodes are handled. It is stored in the [REGISTRATION_MODE_KEY].
+type RegistrationMode string
+
+const (
+	// Unknown nodes are directly created. This is the default if no mode is stored in etcd.
+	REGISTRATION_OPEN RegistrationMode = "open"
+	// Unknown nodes are added to /pending/[pubkey] and need to be approved by an operator.
+	REGISTRATION_APPROVAL RegistrationMode = "approval"
+)
+
+// Indicates that an unknown registration mode was passed or stored in etcd
+var ErrUnknownRegistrationMode = errors.New("Unknown registration mode")
+
+// Indicates that a node which should be approved or rejected is not pending
+var ErrNodeNotPending = errors.New("The node is not pending for approval")
+
+// Details about the requests of an unknown node stored in the /pending/[pubkey] etcd prefix
+// while the node awaits its approval.
+type PendingNode struct {
+	FirstSeen *int64  `json:"first_seen,omitempty" etcd:"first_seen"` // unix timestamp of the first request
+	LastSeen  *int64  `json:"last_seen,omitempty" etcd:"last_seen"`   // unix timestamp of the latest request
+	Address   *string `json:"address,omitempty" etcd:"address"`       // client address of the latest request
+	V6MTU     *uint64 `json:"v6mtu,omitempty" etcd:"v6mtu"`
+}
+
+// Returns the current registration mode.
+func (eh EtcdHandler) GetRegistrationMode(ctx context.Context) (RegistrationMode, error) {
+	resp, err := eh.KV.Get(ctx, REGISTRATION_MODE_KEY)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) == 0 {
+		return REGISTRATION_OPEN, nil
+	}
+
+	mode := RegistrationMode(resp.Kvs[0].Value)
+	switch mode {
+	case REGISTRATION_OPEN, REGISTRATION_APPROVAL:
+		return mode, nil
+	default:
+		return "", ErrUnknownRegistrationMode
+	}
+}
+
+// Stores the registration mode used by all services.
+func (eh EtcdHandler) SetRegistrationMode(ctx context.Context, mode RegistrationMode) error {
+	switch mode {
+	case REGISTRATION_OPEN, REGISTRATION_APPROVAL:
+	default:
+		return ErrUnknownRegistrationMode
+	}
+
+	_, err := eh.KV.Put(ctx, REGISTRATION_MODE_KEY, string(mode))
+	return err
+}
+
+// Records a request of an unknown node in the /pending/[pubkey] etcd prefix.
+//
+// The time of the request is set by this function. Repeated requests update the
+// details, but keep the time of the first request.
+func (eh EtcdHandler) AddPendingNode(ctx context.Context, pubkey string, request PendingNode) error {
+	prefix := PENDING_PREFIX + pubkey + "/"
+
+	now := time.Now().Unix()
+	request.FirstSeen = nil
+	request.LastSeen = &now
+	ops := etcdhelper.Marshal(&request, prefix)
+
+	firstRequest := clientv3.Compare(clientv3.CreateRevision(prefix+"first_seen"), "=", 0)
+	firstSeen := clientv3.OpPut(prefix+"first_seen", strconv.FormatInt(now, 10))
+	_, err := eh.KV.Txn(ctx).If(firstRequest).Then(append(ops, firstSeen)...).Else(ops...).Commit()
+	return err
+}
+
+// Retrieves all nodes waiting for their approval.
+func (eh EtcdHandler) GetPendingNodes(ctx context.Context) (map[string]*PendingNode, error) {
+	list := make(map[string]*PendingNode)
+	if _, err := etcdhelper.UnmarshalGet(ctx, eh.KV, PENDING_PREFIX, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Creates a pending node and removes it from the pending nodes.
+//
+// The node is created like in [EtcdHandler.CreateNode], but never as provisional node.
+// If the node isn't pending, [ErrNodeNotPending] is returned.
+func (eh EtcdHandler) ApproveNode(ctx context.Context, pubkey string, updateNodeInfo func(*NodeInfo) error) error {
+	prefix := PENDING_PREFIX + pubkey + "/"
+	isPending := clientv3.Compare(clientv3.CreateRevision(prefix+"last_seen"), ">", 0)
+	removePending := clientv3.OpDelete(prefix, clientv3.WithPrefix())
+
+	err := eh.createNode(ctx, pubkey, updateNodeInfo, 0, []clientv3.Cmp{isPending}, []clientv3.Op{removePending})
+	if errors.Is(err, ErrConditionFailed) {
+		return ErrNodeNotPending
+	}
+	return err
+}
+
+// Removes a node from the pending nodes without creating it.
+//
+// The node is added again to the pending nodes when it sends another request.
+// If the node isn't pending, [ErrNodeNotPending] is returned.
+func (eh EtcdHandler) RejectNode(ctx context.Context, pubkey string) error {
+	resp, err := eh.KV.Delete(ctx, PENDING_PREFIX+pubkey+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	if resp.Deleted == 0 {
+		return ErrNodeNotPending
+	}
+	return nil
+}
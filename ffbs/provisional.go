@@ -0,0 +1,166 @@
+package ffbs
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// A node id claimed by [EtcdHandler.CreateNode] with the etcd conditions and operations
+// needed to claim the id in the node insertion transaction.
+type idAllocation struct {
+	id     uint64
+	reused bool
+	cmps   []clientv3.Cmp
+	ops    []clientv3.Op
+}
+
+// Returns the next node id to use.
+//
+// Every provisional node is tracked in /provisional/[id] with its pubkey as value. As the
+// tracking key isn't attached to the lease of the node, ids of expired provisional nodes
+// can be found and are reused before taking a new one from [NEXT_FREE_ID_KEY].
+func (eh EtcdHandler) allocateID(ctx context.Context) (*idAllocation, error) {
+	alloc, err := eh.releasedID(ctx)
+	if err != nil || alloc != nil {
+		return alloc, err
+	}
+
+	resp, err := eh.KV.Get(ctx, NEXT_FREE_ID_KEY)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrMissingNextFreeID
+	}
+	id, err := strconv.ParseUint(string(resp.Kvs[0].Value), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &idAllocation{
+		id:   id,
+		cmps: []clientv3.Cmp{clientv3.Compare(clientv3.Value(NEXT_FREE_ID_KEY), "=", strconv.FormatUint(id, 10))},
+		ops:  []clientv3.Op{clientv3.OpPut(NEXT_FREE_ID_KEY, strconv.FormatUint(id+1, 10))},
+	}, nil
+}
+
+// Returns the lowest id of an expired provisional node or nil if there is none.
+func (eh EtcdHandler) releasedID(ctx context.Context) (*idAllocation, error) {
+	resp, err := eh.KV.Get(ctx, PROVISIONAL_PREFIX, clientv3.WithPrefix())
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, err
+	}
+
+	type provisionalNode struct {
+		id     uint64
+		pubkey string
+	}
+	nodes := make([]provisionalNode, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		id, err := strconv.ParseUint(strings.TrimPrefix(string(kv.Key), PROVISIONAL_PREFIX), 10, 64)
+		if err != nil {
+			continue // ignore...
+		}
+		nodes = append(nodes, provisionalNode{id: id, pubkey: string(kv.Value)})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].id < nodes[j].id
+	})
+
+	// check the provisional nodes in chunks, as etcd limits the number of operations in a transaction
+	for len(nodes) > 0 {
+		chunk := nodes[:min(len(nodes), txnChunkSize)]
+		nodes = nodes[len(chunk):]
+
+		gets := make([]clientv3.Op, 0, len(chunk))
+		for _, node := range chunk {
+			gets = append(gets, clientv3.OpGet(CONFIG_PREFIX+node.pubkey+"/id", clientv3.WithCountOnly()))
+		}
+		txresp, err := eh.KV.Txn(ctx).Then(gets...).Commit()
+		if err != nil {
+			return nil, err
+		}
+
+		for i, node := range chunk {
+			if txresp.Responses[i].GetResponseRange().Count > 0 {
+				continue // node still exists
+			}
+
+			provisionalKey := PROVISIONAL_PREFIX + strconv.FormatUint(node.id, 10)
+			return &idAllocation{
+				id:     node.id,
+				reused: true,
+				cmps: []clientv3.Cmp{
+					clientv3.Compare(clientv3.Value(provisionalKey), "=", node.pubkey),
+					clientv3.Compare(clientv3.CreateRevision(CONFIG_PREFIX+node.pubkey+"/id"), "=", 0),
+				},
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Turns a provisional node into a permanent node.
+//
+// All keys of the node are detached from the lease of the node, so they don't expire anymore.
+// Nothing is changed if the node isn't provisional. If the node doesn't exist (anymore),
+// a [NodeNotFoundError] is returned.
+func (eh EtcdHandler) ConfirmNode(ctx context.Context, pubkey string) error {
+	prefix := CONFIG_PREFIX + pubkey + "/"
+	for {
+		resp, err := eh.KV.Get(ctx, prefix, clientv3.WithPrefix())
+		if err != nil {
+			return err
+		}
+		if len(resp.Kvs) == 0 {
+			return &NodeNotFoundError{
+				Pubkey: pubkey,
+			}
+		}
+
+		var leaseKey, leaseValue string
+		var leaseRevision int64
+		var id string
+		ops := make([]clientv3.Op, 0, len(resp.Kvs)+1)
+		for _, kv := range resp.Kvs {
+			key := string(kv.Key)
+			switch key {
+			case prefix + PROVISIONAL_LEASE_KEY:
+				leaseKey, leaseValue, leaseRevision = key, string(kv.Value), kv.ModRevision
+				continue
+			case prefix + "id":
+				id = string(kv.Value)
+			}
+			// a put without a lease detaches the key from its lease
+			ops = append(ops, clientv3.OpPut(key, string(kv.Value)))
+		}
+		if leaseKey == "" {
+			return nil
+		}
+
+		ops = append(ops,
+			clientv3.OpPut(ID_INDEX_PREFIX+id, pubkey),
+			clientv3.OpDelete(leaseKey),
+			clientv3.OpDelete(PROVISIONAL_PREFIX+id),
+			eh.auditOp(pubkey, AUDIT_CONFIRM, map[string]string{PROVISIONAL_LEASE_KEY: leaseValue}, nil),
+		)
+		unchanged := clientv3.Compare(clientv3.ModRevision(leaseKey), "=", leaseRevision)
+		txresp, err := eh.KV.Txn(ctx).If(unchanged).Then(ops...).Commit()
+		if err != nil {
+			return err
+		}
+		if !txresp.Succeeded {
+			continue
+		}
+
+		if leaseID, err := strconv.ParseInt(leaseValue, 10, 64); err == nil && eh.Lease != nil {
+			// the lease doesn't hold any keys anymore. Errors are ignored, as it expires anyway.
+			eh.Lease.Revoke(ctx, clientv3.LeaseID(leaseID))
+		}
+		return nil
+	}
+}
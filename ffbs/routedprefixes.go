@@ -0,0 +1,204 @@
+package ffbs
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Indicates that a prefix overlaps a prefix already used by a node
+type PrefixOverlapError struct {
+	Prefix netip.Prefix
+	Pubkey string       // node using the other prefix
+	Other  netip.Prefix // the overlapped prefix
+}
+
+func (err *PrefixOverlapError) Error() string {
+	return fmt.Sprintf("The prefix %s overlaps the prefix %s of the node '%s'", err.Prefix, err.Other, err.Pubkey)
+}
+
+// Parses a space separated list of prefixes as stored in the routed_prefixes key.
+func ParsePrefixList(list string) ([]netip.Prefix, error) {
+	fields := strings.Fields(list)
+	prefixes := make([]netip.Prefix, 0, len(fields))
+	for _, field := range fields {
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse prefix '%s': %w", field, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Returns the additional prefixes routed to the node besides its ranges.
+func (ni NodeInfo) RoutedPrefixList() ([]netip.Prefix, error) {
+	if ni.RoutedPrefixes == nil {
+		return nil, nil
+	}
+	return ParsePrefixList(*ni.RoutedPrefixes)
+}
+
+// Returns the ranges of the node and optionally its routed prefixes. Invalid values are omitted.
+func (ni NodeInfo) prefixes(withRouted bool) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, r := range []*string{ni.Range4, ni.Range6} {
+		if r == nil {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(*r); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	if withRouted {
+		routed, _ := ni.RoutedPrefixList()
+		prefixes = append(prefixes, routed...)
+	}
+	return prefixes
+}
+
+// Checks the routed prefixes of a node against the address plan and the prefixes of the other nodes.
+//
+// Routed prefixes must be outside of the prefixes of the address plan, so the ranges allocated later never
+// overlap them. Overlaps with the address plan result in an [ErrPrefixInAddressPlan], all other overlaps in a
+// [PrefixOverlapError]. The current routed prefixes of the node itself in nodes are ignored, as they are replaced.
+func checkRoutedPrefixes(pubkey string, prefixes []netip.Prefix, nodes map[string]*NodeInfo, plan AddressAllocator) error {
+	for i, p := range prefixes {
+		p = p.Masked()
+		for _, pool := range plan.Prefixes() {
+			if p.Overlaps(pool) {
+				return fmt.Errorf("%w: %s overlaps %s", ErrPrefixInAddressPlan, p, pool)
+			}
+		}
+		for _, other := range prefixes[:i] {
+			if p.Overlaps(other.Masked()) {
+				return &PrefixOverlapError{Prefix: p, Pubkey: pubkey, Other: other.Masked()}
+			}
+		}
+		for otherPubkey, other := range nodes {
+			if otherPubkey == DEFAULT_NODE_KEY {
+				continue
+			}
+			for _, otherPrefix := range other.prefixes(otherPubkey != pubkey) {
+				if p.Overlaps(otherPrefix) {
+					return &PrefixOverlapError{Prefix: p, Pubkey: otherPubkey, Other: otherPrefix}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Checks the routed prefixes of a node about to be created, see [checkRoutedPrefixes].
+//
+// It returns the conditions the node creation transaction must include, so the check is invalidated by
+// concurrent changes of the nodes or the address plan like in [EtcdHandler.SetRoutedPrefixes].
+func (eh EtcdHandler) checkNewRoutedPrefixes(ctx context.Context, pubkey string, info *NodeInfo) ([]clientv3.Cmp, error) {
+	prefixes, err := info.RoutedPrefixList()
+	if err != nil || len(prefixes) == 0 {
+		return nil, err
+	}
+	txresp, err := eh.KV.Txn(ctx).Then(
+		clientv3.OpGet(CONFIG_PREFIX, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)),
+		clientv3.OpGet(ADDRESS_PLAN_KEY),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+	plan, err := addressPlanFromResponse((*clientv3.GetResponse)(txresp.Responses[1].GetResponseRange()))
+	if err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]*NodeInfo)
+	if _, err := etcdhelper.UnmarshalResponse((*clientv3.GetResponse)(txresp.Responses[0].GetResponseRange()), CONFIG_PREFIX, &nodes); err != nil {
+		return nil, err
+	}
+	if err := checkRoutedPrefixes(pubkey, prefixes, nodes, plan); err != nil {
+		return nil, err
+	}
+	return []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(CONFIG_PREFIX), "<", txresp.Header.Revision+1).WithPrefix(),
+		clientv3.Compare(clientv3.ModRevision(ADDRESS_PLAN_KEY), "<", txresp.Header.Revision+1),
+	}, nil
+}
+
+// Sets the additional prefixes routed to an existing node, e.g. a public IPv4 block or an IPv6 /56.
+//
+// The prefixes are included in the Wireguard AllowedIPs of the node and its configuration.
+// Prefixes overlapping the prefixes of the address plan result in an [ErrPrefixInAddressPlan].
+// Prefixes overlapping each other or any range or routed prefix of a node result in a
+// [PrefixOverlapError]. An empty list removes all routed prefixes.
+// If the node doesn't exist, a [NodeNotFoundError] is returned.
+func (eh EtcdHandler) SetRoutedPrefixes(ctx context.Context, pubkey string, prefixes []netip.Prefix) error {
+	prefix := CONFIG_PREFIX + pubkey + "/"
+	key := prefix + "routed_prefixes"
+
+	list := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		list = append(list, p.Masked().String())
+	}
+
+	for {
+		// all nodes are read and compared in the transaction, as any node change could add an overlap
+		txresp, err := eh.KV.Txn(ctx).Then(
+			clientv3.OpGet(CONFIG_PREFIX, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend)),
+			clientv3.OpGet(ADDRESS_PLAN_KEY),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		resp := (*clientv3.GetResponse)(txresp.Responses[0].GetResponseRange())
+		plan, err := addressPlanFromResponse((*clientv3.GetResponse)(txresp.Responses[1].GetResponseRange()))
+		if err != nil {
+			return err
+		}
+		var leaseOpts []clientv3.OpOption
+		for _, kv := range resp.Kvs {
+			if string(kv.Key) == prefix+"id" && kv.Lease != 0 {
+				// keep the keys of provisional nodes attached to their lease
+				leaseOpts = append(leaseOpts, clientv3.WithLease(clientv3.LeaseID(kv.Lease)))
+			}
+		}
+		nodes := make(map[string]*NodeInfo)
+		if _, err := etcdhelper.UnmarshalResponse(resp, CONFIG_PREFIX, &nodes); err != nil {
+			return err
+		}
+		node, ok := nodes[pubkey]
+		if !ok {
+			return &NodeNotFoundError{
+				Pubkey: pubkey,
+			}
+		}
+		if err := checkRoutedPrefixes(pubkey, prefixes, nodes, plan); err != nil {
+			return err
+		}
+
+		before := make(map[string]string)
+		if node.RoutedPrefixes != nil {
+			before["routed_prefixes"] = *node.RoutedPrefixes
+		}
+		after := make(map[string]string)
+		op := clientv3.OpDelete(key)
+		if len(list) > 0 {
+			after["routed_prefixes"] = strings.Join(list, " ")
+			op = clientv3.OpPut(key, after["routed_prefixes"], leaseOpts...)
+		}
+
+		unchanged := []clientv3.Cmp{
+			clientv3.Compare(clientv3.ModRevision(CONFIG_PREFIX), "<", txresp.Header.Revision+1).WithPrefix(),
+			clientv3.Compare(clientv3.ModRevision(ADDRESS_PLAN_KEY), "<", txresp.Header.Revision+1),
+		}
+		txresp, err = eh.KV.Txn(ctx).If(unchanged...).Then(op, eh.auditOp(pubkey, AUDIT_UPDATE, before, after)).Commit()
+		if err != nil {
+			return err
+		}
+		if txresp.Succeeded {
+			return nil
+		}
+	}
+}
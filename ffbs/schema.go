@@ -0,0 +1,168 @@
+package ffbs
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// A change of the etcd layout from the previous schema version to the given version.
+type Migration struct {
+	Version     uint64
+	Description string
+
+	// Returns the conditions and operations to migrate the etcd layout. They are applied in a single
+	// transaction together with the update of the [SCHEMA_VERSION_KEY]. The conditions should
+	// ensure that the data read by the migration didn't change in the meantime.
+	Migrate func(ctx context.Context, eh EtcdHandler) ([]clientv3.Cmp, []clientv3.Op, error)
+}
+
+// All migrations of the etcd layout sorted by their version.
+//
+// New migrations must be appended with the next version number.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Move the JSON encoded concentrators of /config/default into the /concentrators registry using the addresses derived from the node ranges",
+		Migrate:     migrateConcentratorRegistry,
+	},
+	{
+		Version:     2,
+		Description: "Store the address plan in /address_plan",
+		Migrate:     migrateAddressPlan,
+	},
+	{
+		Version:     3,
+		Description: "Add the nodes created before the id index to /ids/",
+		Migrate:     migrateIDIndex,
+	},
+}
+
+// Returns the schema version supported by this version of the tools.
+func SupportedSchemaVersion() uint64 {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// Returns the schema version stored in etcd. A missing version is reported as version 0.
+func (eh EtcdHandler) GetSchemaVersion(ctx context.Context) (uint64, error) {
+	resp, err := eh.KV.Get(ctx, SCHEMA_VERSION_KEY)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(string(resp.Kvs[0].Value), 10, 64)
+}
+
+// Returns a [SchemaTooNewError] if the etcd layout is newer than the layout supported by these tools.
+//
+// Older layouts are accepted, as all tools stay compatible to them until they are migrated.
+func (eh EtcdHandler) CheckSchemaVersion(ctx context.Context) error {
+	version, err := eh.GetSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if version > SupportedSchemaVersion() {
+		return &SchemaTooNewError{
+			Version:   version,
+			Supported: SupportedSchemaVersion(),
+		}
+	}
+	return nil
+}
+
+// Applies all pending migrations in order and returns the applied migrations.
+//
+// Every migration is applied in its own transaction, which also updates the [SCHEMA_VERSION_KEY].
+// If a migration fails, the already applied migrations are returned with the error.
+func (eh EtcdHandler) Migrate(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	for {
+		version, err := eh.GetSchemaVersion(ctx)
+		if err != nil {
+			return applied, err
+		}
+		if version > SupportedSchemaVersion() {
+			return applied, &SchemaTooNewError{
+				Version:   version,
+				Supported: SupportedSchemaVersion(),
+			}
+		}
+
+		var next *Migration
+		for i := range Migrations {
+			if Migrations[i].Version > version {
+				next = &Migrations[i]
+				break
+			}
+		}
+		if next == nil {
+			return applied, nil
+		}
+
+		cmps, ops, err := next.Migrate(ctx, eh)
+		if err != nil {
+			return applied, err
+		}
+
+		unchanged := clientv3.Compare(clientv3.Version(SCHEMA_VERSION_KEY), "=", 0)
+		if version > 0 {
+			unchanged = clientv3.Compare(clientv3.Value(SCHEMA_VERSION_KEY), "=", strconv.FormatUint(version, 10))
+		}
+		ops = append(ops, clientv3.OpPut(SCHEMA_VERSION_KEY, strconv.FormatUint(next.Version, 10)))
+		txresp, err := eh.KV.Txn(ctx).If(append(cmps, unchanged)...).Then(ops...).Commit()
+		if err != nil {
+			return applied, err
+		}
+		if txresp.Succeeded {
+			applied = append(applied, *next)
+		}
+		// otherwise the data changed concurrently, retry with the current state
+	}
+}
+
+func migrateConcentratorRegistry(ctx context.Context, eh EtcdHandler) ([]clientv3.Cmp, []clientv3.Op, error) {
+	key := CONFIG_PREFIX + DEFAULT_NODE_KEY + "/concentrators"
+	resp, err := eh.KV.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return []clientv3.Cmp{clientv3.Compare(clientv3.Version(key), "=", 0)}, nil, nil
+	}
+
+	registry, err := eh.GetConcentrators(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(registry) > 0 {
+		// the registry is already in use, the JSON encoded concentrators are ignored anyway
+		return nil, nil, nil
+	}
+
+	var concentrators []ConcentratorInfo
+	if err := json.Unmarshal(resp.Kvs[0].Value, &concentrators); err != nil {
+		return nil, nil, err
+	}
+
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision),
+		clientv3.Compare(clientv3.CreateRevision(CONCENTRATOR_PREFIX), "=", 0).WithPrefix(),
+	}
+	ops := []clientv3.Op{clientv3.OpDelete(key)}
+	for _, concentrator := range concentrators {
+		if concentrator.ID == 0 {
+			return nil, nil, ErrInvalidConcentratorID
+		}
+		concentrator.State = CONCENTRATOR_ACTIVE
+		// the registry derives the addresses from the node ranges, see [NodeInfo.ConcentratorAddresses]
+		concentrator.Address4, concentrator.Address6 = "", ""
+		ops = append(ops, etcdhelper.Marshal(&concentrator, concentratorPrefix(concentrator.ID))...)
+	}
+	return cmps, ops, nil
+}
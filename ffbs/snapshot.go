@@ -0,0 +1,337 @@
+package ffbs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+const SNAPSHOT_FORMAT = "ffbs-etcd-snapshot"
+const SNAPSHOT_VERSION = 1
+
+// The etcd prefixes contained in a [Snapshot].
+//
+// The node states, the audit log and provisional nodes are not part of snapshots.
+var SnapshotPrefixes = []string{CONFIG_PREFIX, CONCENTRATOR_PREFIX, ACL_PREFIX, PENDING_PREFIX, ID_INDEX_PREFIX}
+
+// The single etcd keys contained in a [Snapshot].
+var SnapshotKeys = []string{NEXT_FREE_ID_KEY, REGISTRATION_MODE_KEY, SCHEMA_VERSION_KEY, ADDRESS_PLAN_KEY}
+
+// A self-describing copy of the configuration stored in etcd.
+//
+// It is meant to be stored as indented JSON, which results in a sorted, readable and diffable document.
+// Provisional nodes are left out on export and import, as their lease can't be restored.
+// They would turn into permanent nodes otherwise.
+type Snapshot struct {
+	Format        string            `json:"format"`  // always SNAPSHOT_FORMAT
+	Version       int               `json:"version"` // version of the snapshot format
+	SchemaVersion uint64            `json:"schema_version"`
+	Created       time.Time         `json:"created"`
+	Revision      int64             `json:"revision"` // etcd revision of the exported values
+	Values        map[string]string `json:"values"`
+}
+
+// How [EtcdHandler.ImportSnapshot] changes the etcd contents
+type ImportMode string
+
+const (
+	IMPORT_DRY_RUN ImportMode = "dry-run" // only report the changes
+	IMPORT_MERGE   ImportMode = "merge"   // write all values of the snapshot, keep other keys
+	IMPORT_REPLACE ImportMode = "replace" // write all values of the snapshot and delete other keys of the snapshot prefixes
+)
+
+// Changes made (or to be made for [IMPORT_DRY_RUN]) by [EtcdHandler.ImportSnapshot]
+type ImportResult struct {
+	Put       []string // written keys with a new or changed value
+	Deleted   []string
+	Unchanged int
+}
+
+// Indicates that a snapshot has an unknown format or version
+var ErrInvalidSnapshot = errors.New("Unknown snapshot format or version")
+
+// Indicates that an unknown import mode was passed
+var ErrUnknownImportMode = errors.New("Unknown import mode")
+
+func isSnapshotKey(key string) bool {
+	for _, prefix := range SnapshotPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	for _, k := range SnapshotKeys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads all snapshot values at a single etcd revision.
+func (eh EtcdHandler) snapshotValues(ctx context.Context) (map[string]string, int64, error) {
+	gets := make([]clientv3.Op, 0, len(SnapshotPrefixes)+len(SnapshotKeys))
+	for _, prefix := range SnapshotPrefixes {
+		gets = append(gets, clientv3.OpGet(prefix, clientv3.WithPrefix()))
+	}
+	for _, key := range SnapshotKeys {
+		gets = append(gets, clientv3.OpGet(key))
+	}
+	txresp, err := eh.KV.Txn(ctx).Then(gets...).Commit()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	values := make(map[string]string)
+	for _, resp := range txresp.Responses {
+		for _, kv := range resp.GetResponseRange().Kvs {
+			values[string(kv.Key)] = string(kv.Value)
+		}
+	}
+	return withoutProvisionalNodes(values), txresp.Header.Revision, nil
+}
+
+// Removes the keys of provisional nodes including their id index entries and the /provisional/ tracking keys.
+func withoutProvisionalNodes(values map[string]string) map[string]string {
+	provisional := make(map[string]bool)
+	for key := range values {
+		rest, ok := strings.CutPrefix(key, CONFIG_PREFIX)
+		if pubkey, isLease := strings.CutSuffix(rest, "/"+PROVISIONAL_LEASE_KEY); ok && isLease && !strings.Contains(pubkey, "/") {
+			provisional[pubkey] = true
+		}
+	}
+
+	filtered := make(map[string]string, len(values))
+	for key, value := range values {
+		if strings.HasPrefix(key, PROVISIONAL_PREFIX) {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(key, CONFIG_PREFIX); ok {
+			if pubkey, _, _ := strings.Cut(rest, "/"); provisional[pubkey] {
+				continue
+			}
+		}
+		if strings.HasPrefix(key, ID_INDEX_PREFIX) && provisional[value] {
+			continue
+		}
+		filtered[key] = value
+	}
+	return filtered
+}
+
+// Exports the configuration stored in etcd, see [SnapshotPrefixes] and [SnapshotKeys].
+func (eh EtcdHandler) ExportSnapshot(ctx context.Context) (*Snapshot, error) {
+	values, revision, err := eh.snapshotValues(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Format:   SNAPSHOT_FORMAT,
+		Version:  SNAPSHOT_VERSION,
+		Created:  time.Now().UTC(),
+		Revision: revision,
+		Values:   values,
+	}
+	if version, ok := values[SCHEMA_VERSION_KEY]; ok {
+		if snapshot.SchemaVersion, err = strconv.ParseUint(version, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// Checks the routed prefixes of the nodes changed by an import against the values after the import,
+// see [checkRoutedPrefixes].
+func checkImportedRoutedPrefixes(current map[string]string, snapshot *Snapshot, mode ImportMode) error {
+	values := maps.Clone(snapshot.Values)
+	if mode != IMPORT_REPLACE {
+		for key, value := range current {
+			if _, ok := values[key]; !ok {
+				values[key] = value
+			}
+		}
+	}
+
+	changed := make(map[string]bool)
+	resp := &clientv3.GetResponse{}
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		rest, ok := strings.CutPrefix(key, CONFIG_PREFIX)
+		if !ok {
+			continue
+		}
+		if oldValue, ok := current[key]; !ok || oldValue != values[key] {
+			pubkey, _, _ := strings.Cut(rest, "/")
+			changed[pubkey] = true
+		}
+		resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(key), Value: []byte(values[key])})
+	}
+	nodes := make(map[string]*NodeInfo)
+	if _, err := etcdhelper.UnmarshalResponse(resp, CONFIG_PREFIX, &nodes); err != nil {
+		return err
+	}
+
+	plan := DefaultAddressAllocator
+	if value, ok := values[ADDRESS_PLAN_KEY]; ok {
+		var err error
+		if plan, err = parseAddressPlan([]byte(value)); err != nil {
+			return err
+		}
+	}
+
+	for _, pubkey := range slices.Sorted(maps.Keys(changed)) {
+		node, ok := nodes[pubkey]
+		if !ok || pubkey == DEFAULT_NODE_KEY {
+			continue
+		}
+		prefixes, err := node.RoutedPrefixList()
+		if err != nil {
+			return fmt.Errorf("The routed prefixes of the node '%s' are invalid: %w", pubkey, err)
+		}
+		if err := checkRoutedPrefixes(pubkey, prefixes, nodes, plan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Imports a snapshot into etcd.
+//
+// The routed prefixes of the changed nodes are checked like in [EtcdHandler.SetRoutedPrefixes] before
+// anything is written. The changes are applied in multiple transactions, so a failing import may be partially applied.
+// All changes of a single node are applied in the same transaction together with its audit record.
+// Snapshots of a newer schema version than supported are refused with a [SchemaTooNewError].
+func (eh EtcdHandler) ImportSnapshot(ctx context.Context, snapshot *Snapshot, mode ImportMode) (*ImportResult, error) {
+	if snapshot.Format != SNAPSHOT_FORMAT || snapshot.Version != SNAPSHOT_VERSION {
+		return nil, ErrInvalidSnapshot
+	}
+	if snapshot.SchemaVersion > SupportedSchemaVersion() {
+		return nil, &SchemaTooNewError{
+			Version:   snapshot.SchemaVersion,
+			Supported: SupportedSchemaVersion(),
+		}
+	}
+	switch mode {
+	case IMPORT_DRY_RUN, IMPORT_MERGE, IMPORT_REPLACE:
+	default:
+		return nil, ErrUnknownImportMode
+	}
+	// snapshots of older versions may contain provisional nodes
+	filtered := *snapshot
+	filtered.Values = withoutProvisionalNodes(snapshot.Values)
+	snapshot = &filtered
+	for key := range snapshot.Values {
+		if !isSnapshotKey(key) {
+			return nil, fmt.Errorf("The snapshot key '%s' is outside of the snapshot prefixes", key)
+		}
+	}
+
+	current, _, err := eh.snapshotValues(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkImportedRoutedPrefixes(current, snapshot, mode); err != nil {
+		return nil, err
+	}
+
+	// group the changes by their node to apply them together
+	type change struct {
+		ops    []clientv3.Op
+		before map[string]string
+		after  map[string]string
+	}
+	changes := make(map[string]*change)
+	groupOf := func(key string) (string, *change) {
+		group, pubkey := key, ""
+		if rest, ok := strings.CutPrefix(key, CONFIG_PREFIX); ok {
+			if i := strings.IndexByte(rest, '/'); i > 0 {
+				pubkey = rest[:i]
+				group = CONFIG_PREFIX + pubkey + "/"
+			}
+		}
+		if changes[group] == nil {
+			changes[group] = &change{before: make(map[string]string), after: make(map[string]string)}
+		}
+		return pubkey, changes[group]
+	}
+
+	result := &ImportResult{}
+	for key, value := range snapshot.Values {
+		oldValue, ok := current[key]
+		if ok && oldValue == value {
+			result.Unchanged++
+			continue
+		}
+		result.Put = append(result.Put, key)
+		pubkey, c := groupOf(key)
+		c.ops = append(c.ops, clientv3.OpPut(key, value))
+		if pubkey != "" {
+			if ok {
+				c.before[strings.TrimPrefix(key, CONFIG_PREFIX+pubkey+"/")] = oldValue
+			}
+			c.after[strings.TrimPrefix(key, CONFIG_PREFIX+pubkey+"/")] = value
+		}
+	}
+	if mode == IMPORT_REPLACE {
+		for key, oldValue := range current {
+			if _, ok := snapshot.Values[key]; ok {
+				continue
+			}
+			result.Deleted = append(result.Deleted, key)
+			pubkey, c := groupOf(key)
+			c.ops = append(c.ops, clientv3.OpDelete(key))
+			if pubkey != "" {
+				c.before[strings.TrimPrefix(key, CONFIG_PREFIX+pubkey+"/")] = oldValue
+			}
+		}
+	}
+	sort.Strings(result.Put)
+	sort.Strings(result.Deleted)
+
+	if mode == IMPORT_DRY_RUN {
+		return result, nil
+	}
+
+	groups := make([]string, 0, len(changes))
+	for group := range changes {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	var chunk []clientv3.Op
+	commit := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		_, err := eh.KV.Txn(ctx).Then(chunk...).Commit()
+		chunk = nil
+		return err
+	}
+	for _, group := range groups {
+		c := changes[group]
+		ops := c.ops
+		if pubkey, ok := strings.CutPrefix(group, CONFIG_PREFIX); ok && strings.HasSuffix(pubkey, "/") {
+			ops = append(ops, eh.auditOp(strings.TrimSuffix(pubkey, "/"), AUDIT_IMPORT, c.before, c.after))
+		}
+		if len(chunk)+len(ops) > txnChunkSize {
+			if err := commit(); err != nil {
+				return result, err
+			}
+		}
+		chunk = append(chunk, ops...)
+	}
+	if err := commit(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,233 @@
+package ffbs
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitli.stratum0.org/ffbs/etcd-tools/etcdhelper"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Runtime information about a node stored in the /state/[pubkey] etcd prefix.
+//
+// The values are written by the [NodeStateRecorder] whenever a node fetches its configuration.
+type NodeState struct {
+	LastSeen     *int64  `json:"last_seen,omitempty" etcd:"last_seen"` // unix timestamp of the last config fetch
+	IPFamily     *uint64 `json:"ip_family,omitempty" etcd:"ip_family"` // 4 or 6
+	V6MTU        *uint64 `json:"v6mtu,omitempty" etcd:"v6mtu"`
+	RequestCount *uint64 `json:"request_count,omitempty" etcd:"request_count"`
+}
+
+// Returns the parsed LastSeen value.
+//
+// If the node was never seen, it returns nil
+func (ns NodeState) LastSeenTime() *time.Time {
+	if ns.LastSeen == nil {
+		return nil
+	}
+
+	res := time.Unix(*ns.LastSeen, 0)
+	return &res
+}
+
+// Get the state of a single node stored at the /state/[pubkey] etcd prefix.
+//
+// Nodes without any recorded state return an empty [NodeState].
+func (eh EtcdHandler) GetNodeState(ctx context.Context, pubkey string) (*NodeState, error) {
+	state := &NodeState{}
+	if _, err := etcdhelper.UnmarshalGet(ctx, eh.KV, STATE_PREFIX+pubkey+"/", state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Retrieves the states of all nodes with recorded state.
+func (eh EtcdHandler) GetAllNodeStates(ctx context.Context) (map[string]*NodeState, error) {
+	states := make(map[string]*NodeState)
+	if _, err := etcdhelper.UnmarshalGet(ctx, eh.KV, STATE_PREFIX, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// Returns all configured nodes which didn't fetch their configuration since the given time.
+//
+// Nodes which were never seen are included with an empty [NodeState].
+func (eh EtcdHandler) GetStaleNodes(ctx context.Context, since time.Time) (map[string]*NodeState, error) {
+	resp, err := eh.KV.Get(ctx, CONFIG_PREFIX, clientv3.WithKeysOnly(), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	states, err := eh.GetAllNodeStates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := make(map[string]*NodeState)
+	for _, kv := range resp.Kvs {
+		match := ID_KEY.FindSubmatch(kv.Key)
+		if match == nil {
+			continue
+		}
+		pubkey := string(match[1])
+		if pubkey == DEFAULT_NODE_KEY {
+			continue
+		}
+
+		state, ok := states[pubkey]
+		if !ok {
+			state = &NodeState{}
+		}
+		if state.LastSeen == nil || *state.LastSeen < since.Unix() {
+			stale[pubkey] = state
+		}
+	}
+	return stale, nil
+}
+
+type pendingNodeState struct {
+	lastSeen int64
+	ipFamily uint64
+	v6mtu    uint64
+	requests uint64
+}
+
+// Collects node requests in memory and writes the resulting [NodeState] values in batches
+// to etcd. This avoids an etcd write for every single configuration request.
+//
+// Use [EtcdHandler.NewNodeStateRecorder] to create a recorder.
+type NodeStateRecorder struct {
+	kv clientv3.KV
+
+	lock    sync.Mutex
+	pending map[string]*pendingNodeState
+}
+
+// Creates a new [NodeStateRecorder] writing to the etcd of the handler.
+//
+// The recorded values are only written on [NodeStateRecorder.Flush], see also [NodeStateRecorder.Run].
+func (eh EtcdHandler) NewNodeStateRecorder() *NodeStateRecorder {
+	return &NodeStateRecorder{
+		kv:      eh.KV,
+		pending: make(map[string]*pendingNodeState),
+	}
+}
+
+// Records a configuration request of the given node.
+func (r *NodeStateRecorder) RecordRequest(pubkey string, ipFamily uint64, v6mtu uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	state, ok := r.pending[pubkey]
+	if !ok {
+		state = &pendingNodeState{}
+		r.pending[pubkey] = state
+	}
+	state.lastSeen = time.Now().Unix()
+	state.ipFamily = ipFamily
+	state.v6mtu = v6mtu
+	state.requests++
+}
+
+// Writes all recorded requests to etcd.
+//
+// The request counts are added to the already stored values. Nodes which couldn't be
+// written are kept and retried on the next flush.
+func (r *NodeStateRecorder) Flush(ctx context.Context) error {
+	r.lock.Lock()
+	pending := r.pending
+	r.pending = make(map[string]*pendingNodeState)
+	r.lock.Unlock()
+
+	var firstErr error
+	for pubkey, state := range pending {
+		if err := r.writeState(ctx, pubkey, state); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			r.requeue(pubkey, state)
+		}
+	}
+	return firstErr
+}
+
+// Adds a state which failed to be written back to the pending states.
+func (r *NodeStateRecorder) requeue(pubkey string, state *pendingNodeState) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	newer, ok := r.pending[pubkey]
+	if !ok {
+		r.pending[pubkey] = state
+		return
+	}
+	newer.requests += state.requests
+}
+
+func (r *NodeStateRecorder) writeState(ctx context.Context, pubkey string, state *pendingNodeState) error {
+	prefix := STATE_PREFIX + pubkey + "/"
+	countKey := prefix + "request_count"
+
+	resp, err := r.kv.Get(ctx, countKey)
+	if err != nil {
+		return err
+	}
+	for {
+		var count uint64
+		unchanged := clientv3.Compare(clientv3.Version(countKey), "=", 0)
+		if len(resp.Kvs) > 0 {
+			count, err = strconv.ParseUint(string(resp.Kvs[0].Value), 10, 64)
+			if err != nil {
+				log.Println("Resetting unparsable request count of", pubkey, ":", err)
+				count = 0
+			}
+			unchanged = clientv3.Compare(clientv3.ModRevision(countKey), "=", resp.Kvs[0].ModRevision)
+		}
+		count += state.requests
+
+		ops := etcdhelper.Marshal(&NodeState{
+			LastSeen:     &state.lastSeen,
+			IPFamily:     &state.ipFamily,
+			V6MTU:        &state.v6mtu,
+			RequestCount: &count,
+		}, prefix)
+
+		txresp, err := r.kv.Txn(ctx).If(unchanged).Then(ops...).Else(clientv3.OpGet(countKey)).Commit()
+		if err != nil {
+			return err
+		}
+		if txresp.Succeeded {
+			return nil
+		}
+		// someone else updated the counter in the meantime, retry with the new value
+		resp = (*clientv3.GetResponse)(txresp.Responses[0].GetResponseRange())
+	}
+}
+
+// Flushes the recorded requests every interval until the context is done.
+//
+// A final flush is done before returning, which is cancelled after finalTimeout if etcd doesn't respond.
+func (r *NodeStateRecorder) Run(ctx context.Context, interval time.Duration, finalTimeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), finalTimeout)
+			defer cancel()
+			if err := r.Flush(flushCtx); err != nil {
+				log.Println("Error writing the node states:", err)
+			}
+			return
+		case <-ticker.C:
+			if err := r.Flush(ctx); err != nil {
+				log.Println("Error writing the node states:", err)
+			}
+		}
+	}
+}
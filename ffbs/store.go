@@ -0,0 +1,38 @@
+package ffbs
+
+import (
+	"context"
+	"os"
+)
+
+// The node operations needed by the configuration tools.
+//
+// It is implemented by the [EtcdHandler], the [NodeCache] and the [FileNodeStore].
+type NodeStore interface {
+	GetNodeInfo(ctx context.Context, pubkey string) (*NodeInfo, error)
+	GetDefaultNodeInfo(ctx context.Context) (*NodeInfo, error)
+	GetAllNodeInfo(ctx context.Context) (map[string]*NodeInfo, *NodeInfo, error)
+	NodeCount(ctx context.Context) (uint64, error)
+	CreateNode(ctx context.Context, pubkey string, updateNodeInfo func(*NodeInfo) error) error
+	ConfirmNode(ctx context.Context, pubkey string) error
+	GetConcentrators(ctx context.Context) ([]ConcentratorInfo, error)
+	GetNodeConcentrators(ctx context.Context, info *NodeInfo) ([]ConcentratorInfo, error)
+	GetACL(ctx context.Context) (*ACL, error)
+	GetRegistrationMode(ctx context.Context) (RegistrationMode, error)
+	AddPendingNode(ctx context.Context, pubkey string, request PendingNode) error
+	CheckSchemaVersion(ctx context.Context) error
+	GetAddressPlan(ctx context.Context) (AddressAllocator, error)
+}
+
+// Opens the node store configured for the tools.
+//
+// If the [NODE_STORE_DIR_ENV] environment variable is set, a [FileNodeStore] in this directory
+// is returned. Otherwise an etcd connection is established using [CreateEtcdConnection].
+func OpenNodeStore() (NodeStore, error) {
+	if dir := os.Getenv(NODE_STORE_DIR_ENV); dir != "" {
+		return &FileNodeStore{
+			Dir: dir,
+		}, nil
+	}
+	return CreateEtcdConnection()
+}
@@ -3,18 +3,31 @@ package ffbs
 
 import (
 	"net"
-	"strconv"
 	"strings"
 	"time"
 )
 
-// Concentrator configuration encoded as a JSON string in the /config/[pubkey]/concentrator key
+// Operational state of a concentrator in the concentrator registry
+type ConcentratorState string
+
+const (
+	CONCENTRATOR_ACTIVE   ConcentratorState = "active"
+	CONCENTRATOR_DRAINING ConcentratorState = "draining" // the concentrator is about to be removed, nodes should switch to other concentrators
+	CONCENTRATOR_DOWN     ConcentratorState = "down"     // the concentrator is not available, e.g. during maintenance
+)
+
+// Concentrator configuration stored in the /concentrators/[id] etcd prefix.
+//
+// Previously the concentrators were encoded as a JSON string in the /config/[pubkey]/concentrators key,
+// which is still used if the registry is empty or if a node has its own concentrators key.
 type ConcentratorInfo struct {
-	Address4 string `json:"address4"`
-	Address6 string `json:"address6"`
-	Endpoint string `json:"endpoint"`
-	PubKey   string `json:"pubkey"`
-	ID       uint32 `json:"id"`
+	Address4 string            `json:"address4,omitempty" etcd:"address4"`
+	Address6 string            `json:"address6,omitempty" etcd:"address6"`
+	Endpoint string            `json:"endpoint" etcd:"endpoint"`
+	PubKey   string            `json:"pubkey" etcd:"pubkey"`
+	ID       uint32            `json:"id" etcd:"-"` // part of the etcd prefix
+	State    ConcentratorState `json:"-" etcd:"state"`
+	Weight   *uint64           `json:"-" etcd:"weight"` // relative share of assigned nodes, defaults to 1
 }
 
 // The node specific configuration values stored in the /config/[pubkey] etcd prefix.
@@ -33,43 +46,63 @@ type NodeInfo struct {
 	Address4              *string            `json:"address4,omitempty" etcd:"address4"`
 	Address6              *string            `json:"address6,omitempty" etcd:"address6"`
 	SelectedConcentrators *string            `json:"-" etcd:"selected_concentrators"`
+	RoutedPrefixes        *string            `json:"routed_prefixes,omitempty" etcd:"routed_prefixes"` // space separated, see [NodeInfo.RoutedPrefixList]
+	ProvisionalLease      *int64             `json:"-" etcd:"provisional_lease"`
+	Revision              int64              `json:"-" etcd:"-"` // etcd revision the values were read at, zero if unknown
 }
 
-// Returns a bitmask starting from the least significant bit indicating the concentrators to
-// use. Due to the return type this only allows for a maximum of 64 concentrators.
-// In case of no defined concentrator, all concentrators will be selected
-func (ni NodeInfo) SelectedConcentratorsBitmask() uint64 {
-	if ni.SelectedConcentrators == nil {
-		return ^uint64(0)
-	}
+// Administrative information about a node stored in the /config/[pubkey]/meta/ etcd prefix.
+//
+// In contrast to the [NodeInfo] these values are only meant for the operators and are never
+// sent to the node itself.
+type NodeMeta struct {
+	Hostname  *string  `json:"hostname,omitempty" etcd:"hostname"`
+	Contact   *string  `json:"contact,omitempty" etcd:"contact"`
+	Latitude  *float64 `json:"latitude,omitempty" etcd:"latitude"`
+	Longitude *float64 `json:"longitude,omitempty" etcd:"longitude"`
+	Notes     *string  `json:"notes,omitempty" etcd:"notes"`
+	CreatedAt *int64   `json:"created_at,omitempty" etcd:"created_at"` // unix timestamp set by [EtcdHandler.CreateNode]
+}
 
-	var ret uint64
-	for _, num := range strings.Split(*ni.SelectedConcentrators, " ") {
-		n, err := strconv.ParseUint(num, 10, 64)
-		if err != nil {
-			continue // ignore...
-		}
-		if n > 64 || n == 0 {
-			panic("Concentrator number 0 or > 64 found. This is not supported")
-		}
-		ret |= 1 << (n - 1)
+// Returns the parsed CreatedAt value.
+//
+// If the creation time is unknown, it returns nil
+func (nm NodeMeta) CreatedTime() *time.Time {
+	if nm.CreatedAt == nil {
+		return nil
 	}
-	if ret == 0 {
-		return ^uint64(0)
+
+	res := time.Unix(*nm.CreatedAt, 0)
+	return &res
+}
+
+// Returns the set of concentrators selected for this node.
+//
+// In case of no defined concentrator, all concentrators will be selected.
+func (ni NodeInfo) SelectedConcentratorSet() (ConcentratorSet, error) {
+	if ni.SelectedConcentrators == nil {
+		return nil, nil
 	}
-	return ret
+	return ParseConcentratorSet(*ni.SelectedConcentrators)
 }
 
-// Returns the parsed Range4/Range6 values. Empty and invalid values are omitted.
+// Returns the parsed Range4/Range6 values and the routed prefixes. Missing, empty and invalid values are omitted.
 func (ni NodeInfo) IPNets() []net.IPNet {
-	nets := make([]net.IPNet, 0, 2)
-	_, range4, err := net.ParseCIDR(*ni.Range4)
-	if err == nil && range4 != nil {
-		nets = append(nets, *range4)
+	ranges := []string{}
+	for _, r := range []*string{ni.Range4, ni.Range6} {
+		if r != nil {
+			ranges = append(ranges, *r)
+		}
+	}
+	if ni.RoutedPrefixes != nil {
+		ranges = append(ranges, strings.Fields(*ni.RoutedPrefixes)...)
 	}
-	_, range6, err := net.ParseCIDR(*ni.Range6)
-	if err == nil && range6 != nil {
-		nets = append(nets, *range6)
+
+	nets := make([]net.IPNet, 0, len(ranges))
+	for _, r := range ranges {
+		if _, ipnet, err := net.ParseCIDR(r); err == nil && ipnet != nil {
+			nets = append(nets, *ipnet)
+		}
 	}
 
 	return nets